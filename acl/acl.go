@@ -0,0 +1,255 @@
+package acl
+
+import (
+	"bufio"
+	"fmt"
+	"lwmq/mlog"
+	"lwmq/mtopic"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access of rule
+const (
+	Read      = 0x01 // Subscribe
+	Write     = 0x02 // Publish
+	ReadWrite = Read | Write
+)
+
+// Rule one ACL rule
+type Rule struct {
+	Access  byte
+	Filter  string
+	Pattern bool // Substitute %c with client ID and %u with user name
+}
+
+// ACL topic access control list, loaded from rule file:
+//
+//	# Rules before any "user" line apply to all clients
+//	pattern write devices/%c/#
+//	pattern read commands/%c/#
+//	user admin
+//	topic readwrite #
+//
+// A client is denied if no rule allows the access
+type ACL struct {
+	Path    string
+	common  []*Rule
+	users   map[string][]*Rule
+	modTime time.Time
+	stop    chan struct{} // Closed to stop watching
+	lock    *sync.RWMutex
+}
+
+// NewACL load ACL rule file
+func NewACL(path string) (*ACL, error) {
+	a := &ACL{
+		Path:  path,
+		users: make(map[string][]*Rule),
+		stop:  make(chan struct{}),
+		lock:  new(sync.RWMutex),
+	}
+
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func parseAccess(access string) (byte, bool) {
+	switch access {
+	case "read":
+		return Read, true
+	case "write":
+		return Write, true
+	case "readwrite":
+		return ReadWrite, true
+	}
+
+	return 0, false
+}
+
+// Reload read rule file again, old rules are kept if file has error
+func (a *ACL) Reload() error {
+	info, err := os.Stat(a.Path)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(a.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var common []*Rule
+	users := make(map[string][]*Rule)
+	var user *string
+
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "user":
+			if len(fields) != 2 {
+				return fmt.Errorf("%s:%d: expect user <name>", a.Path, lineNo)
+			}
+			name := fields[1]
+			user = &name
+		case "topic", "pattern":
+			if len(fields) != 3 {
+				return fmt.Errorf("%s:%d: expect %s <read|write|readwrite> <filter>", a.Path, lineNo, fields[0])
+			}
+
+			access, ok := parseAccess(fields[1])
+			if !ok {
+				return fmt.Errorf("%s:%d: unknown access %q", a.Path, lineNo, fields[1])
+			}
+
+			rule := &Rule{
+				Access:  access,
+				Filter:  fields[2],
+				Pattern: fields[0] == "pattern",
+			}
+			if !mtopic.ValidFilter(rule.checkFilter()) {
+				return fmt.Errorf("%s:%d: invalid topic filter %q", a.Path, lineNo, rule.Filter)
+			}
+
+			if user == nil {
+				common = append(common, rule)
+			} else {
+				users[*user] = append(users[*user], rule)
+			}
+		default:
+			return fmt.Errorf("%s:%d: unknown keyword %q", a.Path, lineNo, fields[0])
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	a.common = common
+	a.users = users
+	a.modTime = info.ModTime()
+	a.lock.Unlock()
+
+	mlog.Debug("Load ACL file:", a.Path, " rules:", len(common), " users:", len(users))
+	return nil
+}
+
+// Watch reload rule file when it is modified, until Stop
+func (a *ACL) Watch(interval time.Duration) {
+	go func() {
+		for {
+			select {
+			case <-a.stop:
+				return
+			case <-time.After(interval):
+			}
+
+			info, err := os.Stat(a.Path)
+			if err != nil {
+				mlog.Error("Stat ACL file error:", err)
+				continue
+			}
+
+			a.lock.RLock()
+			modified := !info.ModTime().Equal(a.modTime)
+			a.lock.RUnlock()
+
+			if modified {
+				if err := a.Reload(); err != nil {
+					mlog.Error("Reload ACL file error:", err)
+				} else {
+					mlog.Warning("ACL file reloaded:", a.Path)
+				}
+			}
+		}
+	}()
+}
+
+// Stop stop watching rule file
+func (a *ACL) Stop() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	select {
+	case <-a.stop:
+	default:
+		close(a.stop)
+	}
+}
+
+// Filter to validate, placeholders of pattern stand for one level
+func (r *Rule) checkFilter() string {
+	if !r.Pattern {
+		return r.Filter
+	}
+
+	return strings.NewReplacer("%c", "c", "%u", "u").Replace(r.Filter)
+}
+
+// Get rule filter of client, empty if substitution is not a single level
+func (r *Rule) filter(clientID string, username string) string {
+	if !r.Pattern {
+		return r.Filter
+	}
+
+	// Wildcards or separators in client ID must not widen the rule
+	if (strings.Contains(r.Filter, "%c") && (len(clientID) == 0 || strings.ContainsAny(clientID, "/+#"))) ||
+		(strings.Contains(r.Filter, "%u") && (len(username) == 0 || strings.ContainsAny(username, "/+#"))) {
+		return ""
+	}
+
+	// One pass, so "%u" in client ID is not substituted again
+	return strings.NewReplacer("%c", clientID, "%u", username).Replace(r.Filter)
+}
+
+func (a *ACL) check(clientID string, username string, access byte, match func(string) bool) bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	rules := a.common
+	if len(username) > 0 {
+		rules = append(rules[:len(rules):len(rules)], a.users[username]...)
+	}
+
+	for _, rule := range rules {
+		if (rule.Access & access) == 0 {
+			continue
+		}
+
+		filter := rule.filter(clientID, username)
+		if len(filter) > 0 && match(filter) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CanPublish check if client can publish to topic
+func (a *ACL) CanPublish(clientID string, username string, topic string) bool {
+	return a.check(clientID, username, Write, func(filter string) bool {
+		return mtopic.Match(filter, topic)
+	})
+}
+
+// CanSubscribe check if client can subscribe topic filter
+func (a *ACL) CanSubscribe(clientID string, username string, filter string) bool {
+	return a.check(clientID, username, Read, func(rule string) bool {
+		return mtopic.Contains(rule, filter)
+	})
+}
@@ -0,0 +1,244 @@
+package acl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeRules(t *testing.T, path string, rules string) {
+	if err := ioutil.WriteFile(path, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestACL(t *testing.T, rules string) *ACL {
+	path := filepath.Join(t.TempDir(), "acl.conf")
+	writeRules(t, path, rules)
+
+	a, err := NewACL(path)
+	if err != nil {
+		t.Fatalf("load rules: %v", err)
+	}
+
+	return a
+}
+
+func TestParseError(t *testing.T) {
+	cases := []struct {
+		rules string
+		err   string // Part of error, empty if rules are valid
+	}{
+		{"", ""},
+		{"# comment\n\n  \ntopic read a/#\n", ""},
+		{"user\n", ":1: expect user"},
+		{"user a b\n", ":1: expect user"},
+		{"topic read\n", ":1: expect topic"},
+		{"topic read a b\n", ":1: expect topic"},
+		{"pattern write\n", ":1: expect pattern"},
+		{"topic all a\n", `:1: unknown access "all"`},
+		{"topic READ a\n", `:1: unknown access "READ"`},
+		{"topic read a/#/b\n", `:1: invalid topic filter "a/#/b"`},
+		{"topic read a+\n", `:1: invalid topic filter "a+"`},
+		{"pattern read a/%c#\n", `:1: invalid topic filter "a/%c#"`},
+		{"pattern read a/%u/#\n", ""},
+		{"topic read a\nallow a\n", `:2: unknown keyword "allow"`},
+	}
+
+	for _, c := range cases {
+		path := filepath.Join(t.TempDir(), "acl.conf")
+		writeRules(t, path, c.rules)
+
+		_, err := NewACL(path)
+		if len(c.err) == 0 {
+			if err != nil {
+				t.Errorf("rules %q: %v", c.rules, err)
+			}
+		} else if (err == nil) || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("rules %q: error %v, want %q", c.rules, err, c.err)
+		}
+	}
+
+	if _, err := NewACL(filepath.Join(t.TempDir(), "none")); err == nil {
+		t.Error("missing rule file loaded")
+	}
+}
+
+func TestAccess(t *testing.T) {
+	a := newTestACL(t, `
+topic read public/#
+topic write events/+
+user admin
+topic readwrite #
+user sensor
+topic write sensors/#
+user reader
+topic read private/#
+topic write private/+/set
+`)
+
+	cases := []struct {
+		clientID string
+		username string
+		publish  bool
+		topic    string
+		allow    bool
+	}{
+		// Common rules before any user line apply to all clients
+		{"c", "", false, "public/a", true},
+		{"c", "", true, "public/a", false},
+		{"c", "", true, "events/a", true},
+		{"c", "", true, "events/a/b", false},
+		{"c", "sensor", false, "public/#", true},
+		{"c", "sensor", true, "events/a", true},
+
+		// User rules only apply to that user
+		{"c", "sensor", true, "sensors/a/b", true},
+		{"c", "sensor", false, "sensors/a", false},
+		{"c", "reader", true, "sensors/a", false},
+		{"c", "", true, "sensors/a", false},
+		{"c", "reader", false, "private/#", true},
+		{"c", "reader", true, "private/a/set", true},
+		{"c", "reader", true, "private/a/get", false},
+
+		// Subscription must be contained in rule
+		{"c", "", false, "public/+/a", true},
+		{"c", "", false, "#", false},
+		{"c", "", false, "+/a", false},
+		{"c", "admin", false, "#", true},
+		{"c", "admin", true, "any/topic", true},
+
+		// Not listed user and no match is denied
+		{"c", "nobody", true, "private/a/set", false},
+		{"c", "nobody", false, "other", false},
+	}
+
+	for _, c := range cases {
+		var got bool
+		if c.publish {
+			got = a.CanPublish(c.clientID, c.username, c.topic)
+		} else {
+			got = a.CanSubscribe(c.clientID, c.username, c.topic)
+		}
+
+		if got != c.allow {
+			t.Errorf("client %q user %q publish %v %q = %v, want %v",
+				c.clientID, c.username, c.publish, c.topic, got, c.allow)
+		}
+	}
+}
+
+func TestPattern(t *testing.T) {
+	a := newTestACL(t, `
+pattern write devices/%c/#
+pattern read commands/%c
+pattern readwrite users/%u/%c
+`)
+
+	cases := []struct {
+		clientID string
+		username string
+		publish  bool
+		topic    string
+		allow    bool
+	}{
+		{"d1", "", true, "devices/d1/temp", true},
+		{"d1", "", true, "devices/d2/temp", false},
+		{"d1", "", false, "commands/d1", true},
+		{"d1", "", false, "commands/+", false},
+		{"d1", "bob", true, "users/bob/d1", true},
+		{"d1", "bob", false, "users/bob/d1", true},
+		{"d1", "bob", true, "users/alice/d1", false},
+
+		// Hostile client IDs must not widen the rule
+		{"#", "", true, "devices/d2/temp", false},
+		{"+", "", true, "devices/d2/temp", false},
+		{"+", "", false, "commands/+", false},
+		{"d1/x", "", false, "commands/d1/x", false},
+		{"", "", true, "devices//temp", false},
+
+		// Hostile user names
+		{"d1", "#", true, "users/bob/d1", false},
+		{"d1", "+", false, "users/+/d1", false},
+		{"d1", "a/b", true, "users/a/b/d1", false},
+		{"d1", "", true, "users//d1", false},
+
+		// Plain characters are substituted as is
+		{"%u", "bob", true, "users/bob/%u", true},
+		{"$d", "", true, "devices/$d/x", true},
+	}
+
+	for _, c := range cases {
+		var got bool
+		if c.publish {
+			got = a.CanPublish(c.clientID, c.username, c.topic)
+		} else {
+			got = a.CanSubscribe(c.clientID, c.username, c.topic)
+		}
+
+		if got != c.allow {
+			t.Errorf("client %q user %q publish %v %q = %v, want %v",
+				c.clientID, c.username, c.publish, c.topic, got, c.allow)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	a := newTestACL(t, "topic write a\n")
+
+	// Bad file keeps old rules
+	writeRules(t, a.Path, "topic write b\ntopic bad c\n")
+	if err := a.Reload(); err == nil {
+		t.Fatal("bad rules reloaded")
+	}
+	if !a.CanPublish("c", "", "a") || a.CanPublish("c", "", "b") {
+		t.Fatal("old rules not kept")
+	}
+
+	writeRules(t, a.Path, "topic write b\n")
+	if err := a.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if a.CanPublish("c", "", "a") || !a.CanPublish("c", "", "b") {
+		t.Fatal("new rules not applied")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	a := newTestACL(t, "topic write a\n")
+	a.Watch(10 * time.Millisecond)
+	defer a.Stop()
+
+	writeRules(t, a.Path, "topic write b\n")
+	// Modification time may have coarse resolution
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(a.Path, future, future); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !a.CanPublish("c", "", "b") {
+		if time.Now().After(deadline) {
+			t.Fatal("modified rule file not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if a.CanPublish("c", "", "a") {
+		t.Fatal("old rule kept after reload")
+	}
+
+	// Bad file is not loaded by watch
+	writeRules(t, a.Path, "bad\n")
+	future = future.Add(time.Minute)
+	os.Chtimes(a.Path, future, future)
+	time.Sleep(50 * time.Millisecond)
+	if !a.CanPublish("c", "", "b") {
+		t.Fatal("rules dropped after bad reload")
+	}
+
+	a.Stop()
+	a.Stop()
+}
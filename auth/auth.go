@@ -0,0 +1,13 @@
+package auth
+
+// CONNACK return code of authentication
+const (
+	Accepted       = 0x00
+	BadCredentials = 0x04
+	NotAuthorized  = 0x05
+)
+
+// Authenticator check user name and password of CONNECT
+type Authenticator interface {
+	Authenticate(clientID string, username string, password []byte) byte
+}
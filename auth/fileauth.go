@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"lwmq/mlog"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// FileAuth authenticate with static password file,
+// one "username:bcrypt hash" per line, '#' starts a comment
+type FileAuth struct {
+	Path  string
+	users map[string][]byte
+	lock  *sync.RWMutex
+}
+
+// NewFileAuth load password file
+func NewFileAuth(path string) (*FileAuth, error) {
+	a := &FileAuth{
+		Path:  path,
+		users: make(map[string][]byte),
+		lock:  new(sync.RWMutex),
+	}
+
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Reload read password file again
+func (a *FileAuth) Reload() error {
+	file, err := os.Open(a.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		idx := strings.Index(line, ":")
+		if idx <= 0 || idx == len(line)-1 {
+			return fmt.Errorf("%s:%d: expect username:hash", a.Path, lineNo)
+		}
+
+		users[line[:idx]] = []byte(line[idx+1:])
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	a.users = users
+	a.lock.Unlock()
+
+	mlog.Debug("Load password file:", a.Path, " users:", len(users))
+	return nil
+}
+
+// Authenticate check password with bcrypt hash
+func (a *FileAuth) Authenticate(clientID string, username string, password []byte) byte {
+	if len(username) == 0 {
+		return NotAuthorized
+	}
+
+	a.lock.RLock()
+	hash, exist := a.users[username]
+	a.lock.RUnlock()
+
+	if !exist {
+		return BadCredentials
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, password) != nil {
+		return BadCredentials
+	}
+
+	return Accepted
+}
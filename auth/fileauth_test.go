@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func hashPassword(t *testing.T, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(hash)
+}
+
+func writePasswd(t *testing.T, path string, lines ...string) {
+	data := strings.Join(lines, "\n") + "\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileAuth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "passwd")
+	writePasswd(t, path,
+		"# users",
+		"",
+		"alice:"+hashPassword(t, "secret"),
+		"  bob:"+hashPassword(t, "pass:word")+"  ",
+		"plain:secret",
+	)
+
+	a, err := NewFileAuth(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		username string
+		password string
+		code     byte
+	}{
+		{"alice", "secret", Accepted},
+		{"alice", "Secret", BadCredentials},
+		{"alice", "", BadCredentials},
+		{"bob", "pass:word", Accepted},
+		{"bob", "secret", BadCredentials},
+		{"carol", "secret", BadCredentials},
+		{"plain", "secret", BadCredentials}, // Not a bcrypt hash
+		{"", "secret", NotAuthorized},
+		{"# users", "", BadCredentials},
+	}
+
+	for _, c := range cases {
+		if code := a.Authenticate("c", c.username, []byte(c.password)); code != c.code {
+			t.Errorf("user %q password %q: code %d, want %d", c.username, c.password, code, c.code)
+		}
+	}
+}
+
+func TestFileAuthReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "passwd")
+	writePasswd(t, path, "alice:"+hashPassword(t, "old"))
+
+	a, err := NewFileAuth(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Bad file keeps old users
+	writePasswd(t, path, "alice:"+hashPassword(t, "new"), "bob")
+	if err := a.Reload(); (err == nil) || !strings.Contains(err.Error(), ":2: expect username:hash") {
+		t.Fatalf("reload bad file: %v", err)
+	}
+	if a.Authenticate("c", "alice", []byte("old")) != Accepted {
+		t.Fatal("old password not kept")
+	}
+
+	writePasswd(t, path, "alice:"+hashPassword(t, "new"), "bob:"+hashPassword(t, "bob"))
+	if err := a.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if a.Authenticate("c", "alice", []byte("old")) != BadCredentials ||
+		a.Authenticate("c", "alice", []byte("new")) != Accepted ||
+		a.Authenticate("c", "bob", []byte("bob")) != Accepted {
+		t.Fatal("new passwords not applied")
+	}
+
+	for _, line := range []string{":hash", "alice:", "alice"} {
+		writePasswd(t, path, line)
+		if _, err := NewFileAuth(path); err == nil {
+			t.Errorf("line %q loaded", line)
+		}
+	}
+	if _, err := NewFileAuth(filepath.Join(t.TempDir(), "none")); err == nil {
+		t.Error("missing password file loaded")
+	}
+}
@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"lwmq/mlog"
+	"net/http"
+	"time"
+)
+
+// HTTPAuth authenticate by HTTP callback. Credentials are posted as JSON,
+// status 200 accepts, 401 is bad credentials, others are not authorized
+type HTTPAuth struct {
+	URL    string
+	client *http.Client
+}
+
+type httpAuthRequest struct {
+	ClientID string `json:"clientid"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// NewHTTPAuth create HTTP callback authenticator
+func NewHTTPAuth(url string, timeout time.Duration) *HTTPAuth {
+	return &HTTPAuth{
+		URL:    url,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// Authenticate post credentials to callback URL
+func (a *HTTPAuth) Authenticate(clientID string, username string, password []byte) byte {
+	body, err := json.Marshal(&httpAuthRequest{
+		ClientID: clientID,
+		Username: username,
+		Password: string(password),
+	})
+	if err != nil {
+		return NotAuthorized
+	}
+
+	resp, err := a.client.Post(a.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// Deny if callback is not available
+		mlog.Error("Auth callback error:", err)
+		return NotAuthorized
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return Accepted
+	case http.StatusUnauthorized:
+		return BadCredentials
+	default:
+		return NotAuthorized
+	}
+}
@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTPAuth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req httpAuthRequest
+		if (r.Method != http.MethodPost) || (r.Header.Get("Content-Type") != "application/json") {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		switch req.Username {
+		case "alice":
+			if (req.ClientID == "c1") && (req.Password == "secret") {
+				w.WriteHeader(http.StatusOK)
+			} else {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		case "banned":
+			w.WriteHeader(http.StatusForbidden)
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "moved":
+			http.Redirect(w, r, "/other", http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	a := NewHTTPAuth(server.URL, time.Second)
+
+	cases := []struct {
+		clientID string
+		username string
+		password string
+		code     byte
+	}{
+		{"c1", "alice", "secret", Accepted},
+		{"c1", "alice", "wrong", BadCredentials},
+		{"c2", "alice", "secret", BadCredentials},
+		{"c1", "bob", "secret", BadCredentials},
+		{"c1", "banned", "", NotAuthorized},
+		{"c1", "broken", "", NotAuthorized},
+		{"c1", "moved", "", NotAuthorized},
+	}
+
+	for _, c := range cases {
+		if code := a.Authenticate(c.clientID, c.username, []byte(c.password)); code != c.code {
+			t.Errorf("client %q user %q: code %d, want %d", c.clientID, c.username, code, c.code)
+		}
+	}
+}
+
+func TestHTTPAuthUnavailable(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	a := NewHTTPAuth(server.URL, 50*time.Millisecond)
+	start := time.Now()
+	if code := a.Authenticate("c", "alice", []byte("secret")); code != NotAuthorized {
+		t.Errorf("timeout: code %d, want %d", code, NotAuthorized)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("timeout after %v", elapsed)
+	}
+
+	// Nothing listens on closed server
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	a = NewHTTPAuth(closed.URL, time.Second)
+	if code := a.Authenticate("c", "alice", []byte("secret")); code != NotAuthorized {
+		t.Errorf("refused: code %d, want %d", code, NotAuthorized)
+	}
+}
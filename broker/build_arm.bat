@@ -1,4 +1,4 @@
 SET CGO_ENABLED=0
 SET GOOS=linux
 SET GOARCH=arm
-go build mqtt_go.go
+go build -o mqtt_go .
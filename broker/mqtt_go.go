@@ -1,24 +1,453 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"lwmq/acl"
+	"lwmq/auth"
+	"lwmq/config"
 	"lwmq/deviceview"
 	"lwmq/dispatcher"
 	"lwmq/manager"
+	"lwmq/metrics"
 	"lwmq/mlog"
 	"lwmq/service"
+	"lwmq/store"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
 )
 
+// Names of listeners, limits are reloaded by name
+const (
+	nameTCP   = "LWMQ"
+	nameTLS   = "LWMQ-TLS"
+	nameWS    = "LWMQ-WS"
+	nameUDP   = "LWMQ-UDP"
+	nameAdmin = "LWMQ-ADMIN"
+)
+
+// Logger of broker, log.levels key is "main" like compatible calls
+var logger = mlog.New("main")
+
+// Flag of package log levels, like "dispatcher=debug,service=info"
+type levelsFlag struct {
+	cfg *config.Config
+}
+
+func (f levelsFlag) String() string {
+	if f.cfg == nil {
+		return ""
+	}
+
+	var levels []string
+	for pkg, level := range f.cfg.Log.Levels {
+		levels = append(levels, pkg+"="+level)
+	}
+	sort.Strings(levels)
+
+	return strings.Join(levels, ",")
+}
+
+func (f levelsFlag) Set(value string) error {
+	if f.cfg.Log.Levels == nil {
+		f.cfg.Log.Levels = make(map[string]string)
+	}
+
+	for _, item := range strings.Split(value, ",") {
+		kv := strings.SplitN(item, "=", 2)
+		if (len(kv) != 2) || (len(kv[0]) == 0) {
+			return fmt.Errorf("package level %q is not package=level", item)
+		}
+		f.cfg.Log.Levels[kv[0]] = kv[1]
+	}
+
+	return nil
+}
+
+// Bind flags to config, flags are parsed again after config file is loaded
+func bindFlags(fs *flag.FlagSet, cfg *config.Config) {
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Min log level: debug, info, warning or error")
+	fs.Var(levelsFlag{cfg}, "log-levels", "Log level of packages, like dispatcher=debug,service=info")
+	fs.StringVar(&cfg.Log.Format, "log-format", cfg.Log.Format, "Log format: text or json")
+	fs.StringVar(&cfg.Log.File, "log-file", cfg.Log.File, "Log file, empty writes to stdout")
+	fs.IntVar(&cfg.Log.MaxSize, "log-max-size", cfg.Log.MaxSize, "MB of log file before rotation, 0 never rotates")
+	fs.IntVar(&cfg.Log.MaxBackups, "log-max-backups", cfg.Log.MaxBackups, "Count of rotated log files kept")
+	fs.IntVar(&cfg.Workers, "workers", cfg.Workers, "Count of workers handling requests")
+	fs.BoolVar(&cfg.WorkInQueue, "work-in-queue", cfg.WorkInQueue, "Handle requests of one client in sequence")
+	fs.IntVar(&cfg.MaxClients, "max-clients", cfg.MaxClients, "Max connections of all listeners")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "Deadline to drain requests and close clients on SIGTERM")
+	fs.StringVar(&cfg.Store, "store", cfg.Store, "Session and message store file, empty keeps state in memory only")
+	fs.DurationVar(&cfg.StoreSync, "store-sync", cfg.StoreSync, "Interval to sync store file to disk, 0 syncs after every write")
+	fs.DurationVar(&cfg.SysInterval, "sys-interval", cfg.SysInterval, "Interval to publish broker statistics to $SYS topics, 0 disables them")
+	fs.IntVar(&cfg.Queue.MaxMessages, "queue-max-messages", cfg.Queue.MaxMessages, "Max Qos 1 and 2 messages queued for one offline session")
+	fs.IntVar(&cfg.Queue.MaxBytes, "queue-max-bytes", cfg.Queue.MaxBytes, "Max payload bytes queued for one offline session, 0 is no limit")
+	fs.DurationVar(&cfg.Queue.Expiry, "queue-expiry", cfg.Queue.Expiry, "Drop messages queued for offline session longer than this, 0 keeps them")
+
+	fs.StringVar(&cfg.Listener.Net, "net", cfg.Listener.Net, "Network of MQTT listener: tcp4, tcp6, or tcp for IPv4 and IPv6")
+	fs.StringVar(&cfg.Listener.Bind, "bind", cfg.Listener.Bind, "IP address of MQTT listener, empty listens on all addresses")
+	fs.IntVar(&cfg.Listener.Port, "port", cfg.Listener.Port, "MQTT listener port")
+	fs.IntVar(&cfg.Listener.MaxConns, "max-conns", cfg.Listener.MaxConns, "Max connections of MQTT listener, 0 is no limit")
+
+	fs.StringVar(&cfg.TLS.Bind, "tls-bind", cfg.TLS.Bind, "IP address of TLS listener, empty listens on all addresses")
+	fs.IntVar(&cfg.TLS.Port, "tls-port", cfg.TLS.Port, "TLS listener port, 8883 by convention, 0 disables TLS")
+	fs.StringVar(&cfg.TLS.Cert, "tls-cert", cfg.TLS.Cert, "TLS server certificate file")
+	fs.StringVar(&cfg.TLS.Key, "tls-key", cfg.TLS.Key, "TLS server private key file")
+	fs.StringVar(&cfg.TLS.MinVersion, "tls-min-version", cfg.TLS.MinVersion, "Minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	fs.StringVar(&cfg.TLS.ClientCA, "tls-client-ca", cfg.TLS.ClientCA, "CA file to verify client certificates")
+	fs.StringVar(&cfg.TLS.VerifyClient, "tls-verify-client", cfg.TLS.VerifyClient, "Client certificate verification: none, optional or require")
+	fs.BoolVar(&cfg.TLS.CertUsername, "tls-cert-username", cfg.TLS.CertUsername, "Use common name of verified client certificate as user name, without password authentication")
+	fs.IntVar(&cfg.TLS.MaxConns, "tls-max-conns", cfg.TLS.MaxConns, "Max connections of TLS listener, 0 is no limit")
+
+	fs.StringVar(&cfg.WebSocket.Bind, "ws-bind", cfg.WebSocket.Bind, "IP address of WebSocket listener, empty listens on all addresses")
+	fs.IntVar(&cfg.WebSocket.Port, "ws-port", cfg.WebSocket.Port, "WebSocket listener port, 8083 by convention, 0 disables WebSocket")
+	fs.StringVar(&cfg.WebSocket.Path, "ws-path", cfg.WebSocket.Path, "WebSocket URL path")
+	fs.IntVar(&cfg.WebSocket.MaxConns, "ws-max-conns", cfg.WebSocket.MaxConns, "Max connections of WebSocket listener, 0 is no limit")
+
+	fs.StringVar(&cfg.UDP.Bind, "udp-bind", cfg.UDP.Bind, "IP address of UDP listener, empty listens on all addresses")
+	fs.IntVar(&cfg.UDP.Port, "udp-port", cfg.UDP.Port, "UDP listener port for constrained devices, 0 disables UDP")
+	fs.DurationVar(&cfg.UDP.Idle, "udp-idle", cfg.UDP.Idle, "Idle timeout of UDP virtual connection")
+	fs.IntVar(&cfg.UDP.MaxConns, "udp-max-conns", cfg.UDP.MaxConns, "Max connections of UDP listener, 0 is no limit")
+
+	fs.IntVar(&cfg.Admin.Port, "admin-port", cfg.Admin.Port, "Localhost only listener port without authentication, 0 disables it")
+
+	fs.StringVar(&cfg.Auth.Type, "auth", cfg.Auth.Type, "Authenticator of CONNECT: file, http, empty allows all clients")
+	fs.StringVar(&cfg.Auth.File, "auth-file", cfg.Auth.File, "Password file with username:bcrypt hash per line")
+	fs.StringVar(&cfg.Auth.URL, "auth-url", cfg.Auth.URL, "HTTP callback URL to authenticate")
+	fs.DurationVar(&cfg.Auth.Timeout, "auth-timeout", cfg.Auth.Timeout, "Timeout of HTTP callback")
+
+	fs.StringVar(&cfg.ACL.File, "acl-file", cfg.ACL.File, "Topic ACL rule file, empty allows all topics")
+	fs.DurationVar(&cfg.ACL.Reload, "acl-reload", cfg.ACL.Reload, "Interval to check ACL file for changes, 0 disables")
+
+	fs.StringVar(&cfg.DeviceView.Addr, "deviceview-addr", cfg.DeviceView.Addr, "Listen address of device view, empty disables it")
+	fs.StringVar(&cfg.DeviceView.HTML, "deviceview-html", cfg.DeviceView.HTML, "Directory of files replacing built-in device view templates and static files")
+	fs.StringVar(&cfg.DeviceView.Token, "api-token", cfg.DeviceView.Token, "Bearer token of device view pages, metrics and REST API, empty disables API and leaves pages public")
+
+	fs.StringVar(&cfg.Metrics.Addr, "metrics-addr", cfg.Metrics.Addr, "Own listen address of /metrics, empty serves it on device view only")
+}
+
+// Parse config: defaults, then config file, then flags of args
+func parseConfig(args []string, handling flag.ErrorHandling) (*config.Config, bool, error) {
+	cfg := config.Default()
+
+	fs := flag.NewFlagSet(os.Args[0], handling)
+	configFile := fs.String("config", "", "YAML config file, flags override settings of file")
+	printConfig := fs.Bool("print-config", false, "Print effective config and exit")
+	bindFlags(fs, cfg)
+
+	if err := fs.Parse(args); err != nil {
+		return nil, false, err
+	}
+
+	if len(*configFile) > 0 {
+		if err := cfg.Load(*configFile); err != nil {
+			return nil, false, err
+		}
+
+		// Flags given on command line override config file
+		fs.Parse(args)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, false, err
+	}
+
+	return cfg, *printConfig, nil
+}
+
+// Set log levels and format from config
+func applyLog(cfg *config.Config) {
+	level, _ := mlog.LevelByName(cfg.LogLevel)
+	mlog.SetMinLevel(level)
+
+	mlog.ClearLevels()
+	for pkg, name := range cfg.Log.Levels {
+		level, _ := mlog.LevelByName(name)
+		mlog.SetLevel(pkg, level)
+	}
+
+	mlog.SetFormat(cfg.Log.Format)
+}
+
+// Create authenticator from auth config
+func newAuthenticator(a *config.Auth) (auth.Authenticator, error) {
+	switch a.Type {
+	case "file":
+		return auth.NewFileAuth(a.File)
+	case "http":
+		return auth.NewHTTPAuth(a.URL, a.Timeout), nil
+	}
+
+	return nil, nil
+}
+
+// Auth config of listeners by name, nil if listener uses auth of broker
+func listenerAuthConfigs(cfg *config.Config) map[string]*config.Auth {
+	return map[string]*config.Auth{
+		nameTCP: cfg.Listener.Auth,
+		nameTLS: cfg.TLS.Auth,
+		nameWS:  cfg.WebSocket.Auth,
+		nameUDP: cfg.UDP.Auth,
+	}
+}
+
+// Create authenticators of listeners with own auth, by listener name, nil
+// authenticator allows all clients of listener
+func newListenerAuths(cfg *config.Config) (map[string]auth.Authenticator, error) {
+	auths := make(map[string]auth.Authenticator)
+
+	for name, a := range listenerAuthConfigs(cfg) {
+		if a == nil {
+			continue
+		}
+
+		conf := *a
+		if conf.Timeout == 0 {
+			conf.Timeout = cfg.Auth.Timeout
+		}
+
+		authenticator, err := newAuthenticator(&conf)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %v", name, err)
+		}
+		auths[name] = authenticator
+	}
+
+	return auths, nil
+}
+
+// Set authenticators of listeners, listeners without own auth use auth of broker
+func setListenerAuths(auths map[string]auth.Authenticator) {
+	for _, name := range []string{nameTCP, nameTLS, nameWS, nameUDP} {
+		if a, exist := auths[name]; exist {
+			dispatcher.Mserver.SetListenerAuth(name, a)
+		} else {
+			dispatcher.Mserver.ClearListenerAuth(name)
+		}
+	}
+}
+
+// Load topic ACL from config
+func newACL(cfg *config.Config) (*acl.ACL, error) {
+	if len(cfg.ACL.File) == 0 {
+		return nil, nil
+	}
+
+	a, err := acl.NewACL(cfg.ACL.File)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.ACL.Reload > 0 {
+		a.Watch(cfg.ACL.Reload)
+	}
+
+	return a, nil
+}
+
+// Limits of offline queues from config
+func queueLimits(cfg *config.Config) dispatcher.QueueLimits {
+	return dispatcher.QueueLimits{
+		MaxMessages: cfg.Queue.MaxMessages,
+		MaxBytes:    cfg.Queue.MaxBytes,
+		Expiry:      cfg.Queue.Expiry,
+	}
+}
+
+// Open store and restore broker state from it
+func loadStore(cfg *config.Config) {
+	if len(cfg.Store) == 0 {
+		return
+	}
+
+	st, err := store.NewFileStore(cfg.Store, cfg.StoreSync)
+	if err != nil {
+		logger.Error("Open store error", "file", cfg.Store, "error", err)
+		os.Exit(1)
+	}
+
+	dispatcher.Mserver.SetStore(st)
+	if err := dispatcher.Mserver.LoadStore(); err != nil {
+		logger.Error("Load store error", "file", cfg.Store, "error", err)
+		os.Exit(1)
+	}
+}
+
+// Serve /metrics on its own address
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Default)
+
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Error("Metrics stopped", "addr", addr, "error", err)
+	}
+}
+
+// Create listeners from config
+func newListeners(cfg *config.Config) *service.Listeners {
+	if err := service.Cids.SetCapacity(cfg.MaxClients); err != nil {
+		logger.Error("Set max clients error", "max_clients", cfg.MaxClients, "error", err)
+		os.Exit(1)
+	}
+
+	listeners := service.NewListeners()
+
+	add := func(s *service.Lwmq) {
+		if err := listeners.Add(s); err != nil {
+			logger.Error("Add listener error", "listener", s.Name, "error", err)
+			os.Exit(1)
+		}
+	}
+
+	lwmq := service.NewLwmqNet(cfg.Listener.Net, cfg.Listener.Bind, cfg.Listener.Port).(*service.Lwmq)
+	lwmq.Name = nameTCP
+	lwmq.MaxConns = cfg.Listener.MaxConns
+	add(lwmq)
+
+	if cfg.TLS.Port > 0 {
+		tlsService := service.NewLwmqTLS(&service.TLSConfig{
+			Port:           cfg.TLS.Port,
+			CertFile:       cfg.TLS.Cert,
+			KeyFile:        cfg.TLS.Key,
+			MinVersion:     cfg.TLS.MinVersion,
+			ClientCAFile:   cfg.TLS.ClientCA,
+			VerifyClient:   cfg.TLS.VerifyClient,
+			CertNameAsUser: cfg.TLS.CertUsername,
+		}).(*service.Lwmq)
+		tlsService.Name = nameTLS
+		if len(cfg.TLS.Bind) > 0 {
+			tlsService.IP = cfg.TLS.Bind
+		}
+		tlsService.MaxConns = cfg.TLS.MaxConns
+		add(tlsService)
+	}
+
+	if cfg.WebSocket.Port > 0 {
+		wsService := service.NewLwmqWS(cfg.WebSocket.Port, cfg.WebSocket.Path).(*service.Lwmq)
+		wsService.Name = nameWS
+		if len(cfg.WebSocket.Bind) > 0 {
+			wsService.IP = cfg.WebSocket.Bind
+		}
+		wsService.MaxConns = cfg.WebSocket.MaxConns
+		add(wsService)
+	}
+
+	if cfg.UDP.Port > 0 {
+		udpService := service.NewLwmqNet("udp", cfg.UDP.Bind, cfg.UDP.Port).(*service.Lwmq)
+		udpService.Name = nameUDP
+		udpService.IdleTimeout = cfg.UDP.Idle
+		udpService.MaxConns = cfg.UDP.MaxConns
+		add(udpService)
+	}
+
+	if cfg.Admin.Port > 0 {
+		adminService := service.NewLwmqNet("tcp4", "127.0.0.1", cfg.Admin.Port).(*service.Lwmq)
+		adminService.Name = nameAdmin
+		add(adminService)
+
+		// Only local clients reach admin listener, no authentication
+		dispatcher.Mserver.SetListenerAuth(adminService.Name, nil)
+	}
+
+	return listeners
+}
+
 func main() {
-	mlog.SetMinLevel(mlog.WARNING)
+	cfg, printConfig, err := parseConfig(os.Args[1:], flag.ExitOnError)
+	if err != nil {
+		logger.Error("Load config error", "error", err)
+		os.Exit(1)
+	}
+
+	if printConfig {
+		fmt.Print(cfg.String())
+		return
+	}
+
+	service.PrintBanner()
+
+	if len(cfg.Log.File) > 0 {
+		file, err := mlog.OpenRotateFile(cfg.Log.File, int64(cfg.Log.MaxSize)<<20, cfg.Log.MaxBackups)
+		if err != nil {
+			logger.Error("Open log file error", "file", cfg.Log.File, "error", err)
+			os.Exit(1)
+		}
+		mlog.SetOutput(file)
+	}
+	applyLog(cfg)
 
-	deviceview.Startservice()
+	authenticator, err := newAuthenticator(&cfg.Auth)
+	if err != nil {
+		logger.Error("Load authenticator error", "error", err)
+		os.Exit(1)
+	}
+	dispatcher.Mserver.SetAuthenticator(authenticator)
 
-	manager.ClientManager.SetWorkInQueue(true)
+	listenerAuths, err := newListenerAuths(cfg)
+	if err != nil {
+		logger.Error("Load authenticator error", "error", err)
+		os.Exit(1)
+	}
+	setListenerAuths(listenerAuths)
+
+	topicACL, err := newACL(cfg)
+	if err != nil {
+		logger.Error("Load ACL file error", "file", cfg.ACL.File, "error", err)
+		os.Exit(1)
+	}
+	dispatcher.Mserver.SetACL(topicACL)
+
+	loadStore(cfg)
+
+	if len(cfg.DeviceView.Addr) > 0 {
+		if err := deviceview.Startservice(cfg.DeviceView.Addr, cfg.DeviceView.HTML, cfg.DeviceView.Token); err != nil {
+			logger.Error("Start device view error", "addr", cfg.DeviceView.Addr, "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if len(cfg.Metrics.Addr) > 0 {
+		go serveMetrics(cfg.Metrics.Addr)
+	}
+
+	manager.ClientManager.SetWorkInQueue(cfg.WorkInQueue)
 	manager.ClientManager.SetOnAdd(dispatcher.OnAddClient)
-	manager.ClientManager.StartWorkers(15)
+	manager.ClientManager.StartWorkers(cfg.Workers)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	dispatcher.Mserver.SetSysInterval(cfg.SysInterval)
+	dispatcher.Mserver.SetQueueLimits(queueLimits(cfg))
+	dispatcher.Mserver.Start(ctx)
+
+	listeners := newListeners(cfg)
+	listeners.SetOnConnect(manager.ClientOnConn)
+	listeners.RegisterMetrics()
+	if err := listeners.StartAll(); err != nil {
+		logger.Error("Start listeners error", "error", err)
+		os.Exit(1)
+	}
+
+	b := newBroker(cfg, os.Args[1:], listeners, topicACL)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	for s := range sig {
+		logger.Warning("Got signal", "signal", s)
+
+		if s == syscall.SIGHUP {
+			b.reload()
+			continue
+		}
 
-	lwmq := service.NewLwmq()
-	// setConnHandler
-	lwmq.SetOnConnect(manager.ClientOnConn)
-	lwmq.Start()
+		if err := b.shutdown(cancel); err != nil {
+			logger.Error("Shutdown error", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
 }
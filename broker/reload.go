@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"lwmq/acl"
+	"lwmq/config"
+	"lwmq/dispatcher"
+	"lwmq/manager"
+	"lwmq/service"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Settings applied without restart, key or prefix of key
+var liveSettings = []string{
+	"log_level",
+	"log.format",
+	"log.levels.",
+	"workers",
+	"max_clients",
+	"shutdown_timeout",
+	"sys_interval",
+	"queue.",
+	"listener.max_conns",
+	"tls.max_conns",
+	"websocket.max_conns",
+	"udp.max_conns",
+	"listener.auth.",
+	"tls.auth.",
+	"websocket.auth.",
+	"udp.auth.",
+	"auth.",
+	"acl.",
+}
+
+// Time to flush in-flight state and close store after shutdown_timeout is passed
+const flushTimeout = 3 * time.Second
+
+// Check if setting is applied without restart
+func isLive(key string) bool {
+	for _, live := range liveSettings {
+		if (key == live) || (strings.HasSuffix(live, ".") && strings.HasPrefix(key, live)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check if auth configs are equal, nil is auth of broker
+func sameAuth(a *config.Auth, b *config.Auth) bool {
+	if (a == nil) || (b == nil) {
+		return a == b
+	}
+
+	return *a == *b
+}
+
+// broker running state, config is reloaded on SIGHUP
+type broker struct {
+	cfg       *config.Config // Effective config
+	args      []string       // Command line flags, override config file on reload
+	listeners *service.Listeners
+	acl       *acl.ACL
+	lock      *sync.Mutex
+}
+
+// Reload config file and flags, apply settings which can change live
+func (b *broker) reload() (*config.Report, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	cfg, _, err := parseConfig(b.args, flag.ContinueOnError)
+	if err != nil {
+		logger.Error("Reload config error", "error", err)
+		return nil, err
+	}
+
+	// Password and ACL files are read again even if config is not changed
+	authenticator, err := newAuthenticator(&cfg.Auth)
+	if err != nil {
+		logger.Error("Reload authenticator error", "error", err)
+		return nil, err
+	}
+
+	listenerAuths, err := newListenerAuths(cfg)
+	if err != nil {
+		logger.Error("Reload authenticator error", "error", err)
+		return nil, err
+	}
+
+	topicACL, err := newACL(cfg)
+	if err != nil {
+		logger.Error("Reload ACL file error", "file", cfg.ACL.File, "error", err)
+		return nil, err
+	}
+
+	report := &config.Report{}
+	effective := *b.cfg
+
+	changed := b.cfg.Diff(cfg)
+	for _, key := range changed {
+		if !isLive(key) {
+			report.Restart = append(report.Restart, key)
+		}
+	}
+
+	for _, key := range changed {
+		if (key == "log_level") || (key == "log.format") || strings.HasPrefix(key, "log.levels.") {
+			report.Applied = append(report.Applied, key)
+		}
+	}
+	applyLog(cfg)
+	effective.LogLevel = cfg.LogLevel
+	effective.Log.Format = cfg.Log.Format
+	effective.Log.Levels = cfg.Log.Levels
+
+	if cfg.Workers != effective.Workers {
+		manager.ClientManager.SetWorkers(cfg.Workers)
+		effective.Workers = cfg.Workers
+		report.Applied = append(report.Applied, "workers")
+	}
+
+	if cfg.MaxClients != effective.MaxClients {
+		if err := service.Cids.SetCapacity(cfg.MaxClients); err != nil {
+			logger.Warning("Max clients not applied", "max_clients", cfg.MaxClients, "error", err)
+			report.Restart = append(report.Restart, "max_clients")
+		} else {
+			if pending := service.Cids.Pending(); pending > 0 {
+				logger.Warning("Max clients shrink deferred until connections above it close",
+					"max_clients", pending, "used", service.Cids.Used())
+				report.Deferred = append(report.Deferred, "max_clients")
+			}
+			effective.MaxClients = cfg.MaxClients
+			report.Applied = append(report.Applied, "max_clients")
+		}
+	}
+
+	if cfg.ShutdownTimeout != effective.ShutdownTimeout {
+		effective.ShutdownTimeout = cfg.ShutdownTimeout
+		report.Applied = append(report.Applied, "shutdown_timeout")
+	}
+
+	if cfg.SysInterval != effective.SysInterval {
+		dispatcher.Mserver.SetSysInterval(cfg.SysInterval)
+		effective.SysInterval = cfg.SysInterval
+		report.Applied = append(report.Applied, "sys_interval")
+	}
+
+	if cfg.Queue != effective.Queue {
+		dispatcher.Mserver.SetQueueLimits(queueLimits(cfg))
+		effective.Queue = cfg.Queue
+		report.Applied = append(report.Applied, "queue")
+	}
+
+	// Limits of running listeners
+	for _, limit := range []struct {
+		key  string
+		name string
+		from *int
+		to   int
+	}{
+		{"listener.max_conns", nameTCP, &effective.Listener.MaxConns, cfg.Listener.MaxConns},
+		{"tls.max_conns", nameTLS, &effective.TLS.MaxConns, cfg.TLS.MaxConns},
+		{"websocket.max_conns", nameWS, &effective.WebSocket.MaxConns, cfg.WebSocket.MaxConns},
+		{"udp.max_conns", nameUDP, &effective.UDP.MaxConns, cfg.UDP.MaxConns},
+	} {
+		if *limit.from == limit.to {
+			continue
+		}
+
+		// Listener not running takes the limit when it is started on restart
+		s := b.listeners.Get(limit.name)
+		if s == nil {
+			report.Restart = append(report.Restart, limit.key)
+			continue
+		}
+
+		s.SetMaxConns(limit.to)
+		*limit.from = limit.to
+		report.Applied = append(report.Applied, limit.key)
+	}
+
+	// Authenticator and ACL are replaced to apply files read again, they are
+	// reported only if their settings changed
+	dispatcher.Mserver.SetAuthenticator(authenticator)
+	if cfg.Auth != effective.Auth {
+		effective.Auth = cfg.Auth
+		report.Applied = append(report.Applied, "auth")
+	}
+
+	// Auth of listeners, listeners without own auth use auth of broker
+	setListenerAuths(listenerAuths)
+	for _, la := range []struct {
+		key  string
+		from **config.Auth
+		to   *config.Auth
+	}{
+		{"listener.auth", &effective.Listener.Auth, cfg.Listener.Auth},
+		{"tls.auth", &effective.TLS.Auth, cfg.TLS.Auth},
+		{"websocket.auth", &effective.WebSocket.Auth, cfg.WebSocket.Auth},
+		{"udp.auth", &effective.UDP.Auth, cfg.UDP.Auth},
+	} {
+		if !sameAuth(*la.from, la.to) {
+			report.Applied = append(report.Applied, la.key)
+		}
+		*la.from = la.to
+	}
+
+	dispatcher.Mserver.SetACL(topicACL)
+	if b.acl != nil {
+		b.acl.Stop()
+	}
+	b.acl = topicACL
+	if cfg.ACL != effective.ACL {
+		effective.ACL = cfg.ACL
+		report.Applied = append(report.Applied, "acl")
+	}
+
+	b.cfg = &effective
+
+	logger.Warning("Config reloaded", "applied", report.Applied, "restart", report.Restart, "deferred", report.Deferred)
+	return report, nil
+}
+
+// Stop accepting, drain requests, flush state and close store, then close connections
+func (b *broker) shutdown(cancel context.CancelFunc) error {
+	b.lock.Lock()
+	ctx, done := context.WithTimeout(context.Background(), b.cfg.ShutdownTimeout)
+	b.lock.Unlock()
+	defer done()
+
+	// No keep alive check, will or resend while shutting down
+	cancel()
+
+	// Stop accepting, connections stay open to send responses of drained requests
+	b.listeners.StopAccept()
+
+	err := manager.ClientManager.Shutdown(ctx)
+
+	// Flush in-flight state and close store even if requests are not drained
+	flushCtx := ctx
+	if err != nil {
+		logger.Error("Drain requests error", "error", err)
+
+		var flushDone context.CancelFunc
+		flushCtx, flushDone = context.WithTimeout(context.Background(), flushTimeout)
+		defer flushDone()
+	}
+
+	if flushErr := dispatcher.Mserver.Shutdown(flushCtx); (flushErr != nil) && (err == nil) {
+		err = flushErr
+	}
+
+	// Close connections left, like ones never sent CONNECT
+	b.listeners.CloseConns()
+
+	return err
+}
+
+// Create broker state of running config
+func newBroker(cfg *config.Config, args []string, listeners *service.Listeners, topicACL *acl.ACL) *broker {
+	return &broker{
+		cfg:       cfg,
+		args:      args,
+		listeners: listeners,
+		acl:       topicACL,
+		lock:      new(sync.Mutex),
+	}
+}
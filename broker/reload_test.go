@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"lwmq/service"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, path string, yaml string) {
+	if err := ioutil.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Create broker with TCP listener not started, TLS listener is disabled
+func newTestBroker(t *testing.T, yaml string, flags ...string) *broker {
+	path := filepath.Join(t.TempDir(), "lwmq.yaml")
+	writeConfig(t, path, yaml)
+
+	args := append([]string{"-config", path}, flags...)
+	cfg, _, err := parseConfig(args, flag.ContinueOnError)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listeners := service.NewListeners()
+	lwmq := service.NewLwmqNet(cfg.Listener.Net, cfg.Listener.Bind, cfg.Listener.Port).(*service.Lwmq)
+	lwmq.Name = nameTCP
+	lwmq.MaxConns = cfg.Listener.MaxConns
+	if err := listeners.Add(lwmq); err != nil {
+		t.Fatal(err)
+	}
+
+	return newBroker(cfg, args, listeners, nil)
+}
+
+func reloadConfig(t *testing.T, b *broker, yaml string) ([]string, []string) {
+	writeConfig(t, b.args[1], yaml)
+
+	report, err := b.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(report.Applied)
+	sort.Strings(report.Restart)
+	return report.Applied, report.Restart
+}
+
+func TestReload(t *testing.T) {
+	b := newTestBroker(t, "listener:\n  max_conns: 10\n")
+
+	applied, restart := reloadConfig(t, b, `
+sys_interval: 30s
+listener:
+  port: 1884
+  max_conns: 20
+tls:
+  max_conns: 5
+`)
+	if got := strings.Join(applied, ","); got != "listener.max_conns,sys_interval" {
+		t.Errorf("applied %s", got)
+	}
+	if got := strings.Join(restart, ","); got != "listener.port,tls.max_conns" {
+		t.Errorf("restart %s", got)
+	}
+
+	if max := b.listeners.Get(nameTCP).MaxConns; max != 20 {
+		t.Errorf("max conns of running listener %d, want 20", max)
+	}
+	if (b.cfg.Listener.MaxConns != 20) || (b.cfg.Listener.Port != 1883) {
+		t.Errorf("effective listener %+v", b.cfg.Listener)
+	}
+
+	// Settings need restart are reported until restart
+	if b.cfg.TLS.MaxConns != 0 {
+		t.Errorf("effective tls.max_conns %d of stopped listener", b.cfg.TLS.MaxConns)
+	}
+	applied, restart = reloadConfig(t, b, `
+sys_interval: 30s
+listener:
+  port: 1884
+  max_conns: 20
+tls:
+  max_conns: 5
+`)
+	if (len(applied) != 0) || (strings.Join(restart, ",") != "listener.port,tls.max_conns") {
+		t.Errorf("applied %v restart %v of same config", applied, restart)
+	}
+}
+
+func TestReloadFlags(t *testing.T) {
+	// Flags override config file on reload
+	b := newTestBroker(t, "workers: 2\n", "-workers", "3")
+	if b.cfg.Workers != 3 {
+		t.Fatalf("workers %d, want 3", b.cfg.Workers)
+	}
+
+	applied, restart := reloadConfig(t, b, "workers: 4\n")
+	if (len(applied) != 0) || (len(restart) != 0) {
+		t.Errorf("applied %v restart %v, flag overridden", applied, restart)
+	}
+
+	// Bad config keeps running config
+	writeConfig(t, b.args[1], "workers: [\n")
+	if _, err := b.reload(); err == nil {
+		t.Fatal("bad config reloaded")
+	}
+	if b.cfg.Workers != 3 {
+		t.Errorf("workers %d after bad reload, want 3", b.cfg.Workers)
+	}
+}
@@ -0,0 +1,398 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"lwmq/mlog"
+	"lwmq/service"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Listener MQTT listener over TCP
+type Listener struct {
+	Net      string `yaml:"net"`  // tcp4, tcp6, or tcp for IPv4 and IPv6
+	Bind     string `yaml:"bind"` // IP address to listen on, empty is all addresses
+	Port     int    `yaml:"port"`
+	MaxConns int    `yaml:"max_conns"`      // 0 is no limit
+	Auth     *Auth  `yaml:"auth,omitempty"` // Replaces auth of broker, nil uses it
+}
+
+// TLS MQTT listener over TLS, port 0 disables it
+type TLS struct {
+	Bind         string `yaml:"bind"`
+	Port         int    `yaml:"port"`
+	Cert         string `yaml:"cert"`
+	Key          string `yaml:"key"`
+	MinVersion   string `yaml:"min_version"`
+	ClientCA     string `yaml:"client_ca"`
+	VerifyClient string `yaml:"verify_client"`
+	CertUsername bool   `yaml:"cert_username"` // Verified certificate name is user name, auth is skipped, ACL applies
+	MaxConns     int    `yaml:"max_conns"`
+	Auth         *Auth  `yaml:"auth,omitempty"`
+}
+
+// WebSocket MQTT listener over WebSocket, port 0 disables it
+type WebSocket struct {
+	Bind     string `yaml:"bind"`
+	Port     int    `yaml:"port"`
+	Path     string `yaml:"path"`
+	MaxConns int    `yaml:"max_conns"`
+	Auth     *Auth  `yaml:"auth,omitempty"`
+}
+
+// UDP MQTT listener over UDP, port 0 disables it
+type UDP struct {
+	Bind     string        `yaml:"bind"`
+	Port     int           `yaml:"port"`
+	Idle     time.Duration `yaml:"idle"`
+	MaxConns int           `yaml:"max_conns"`
+	Auth     *Auth         `yaml:"auth,omitempty"`
+}
+
+// Queue Qos 1 and 2 messages queued for offline persistent session
+type Queue struct {
+	MaxMessages int           `yaml:"max_messages"` // Messages of one session
+	MaxBytes    int           `yaml:"max_bytes"`    // Payload bytes of one session, 0 is no limit
+	Expiry      time.Duration `yaml:"expiry"`       // Drop queued messages older than this, 0 keeps them
+}
+
+// Admin localhost only listener without authentication, port 0 disables it
+type Admin struct {
+	Port int `yaml:"port"`
+}
+
+// Auth authenticator of CONNECT
+type Auth struct {
+	Type    string        `yaml:"type"` // file, http, empty allows all clients
+	File    string        `yaml:"file"`
+	URL     string        `yaml:"url"`
+	Timeout time.Duration `yaml:"timeout"` // 0 of listener auth uses timeout of broker auth
+}
+
+// ACL topic access control list
+type ACL struct {
+	File   string        `yaml:"file"` // Empty allows all topics
+	Reload time.Duration `yaml:"reload"`
+}
+
+// DeviceView web page of devices
+type DeviceView struct {
+	Addr  string `yaml:"addr"`  // Empty disables device view
+	HTML  string `yaml:"html"`  // Directory of files replacing built-in templates and static/ files, may be empty
+	Token string `yaml:"token"` // Bearer token of pages, metrics and REST API, empty disables API and leaves pages public
+}
+
+// Metrics Prometheus metrics at /metrics
+type Metrics struct {
+	Addr string `yaml:"addr"` // Own listen address, empty serves metrics on device view only
+}
+
+// Log output of broker
+type Log struct {
+	Format     string            `yaml:"format"`      // text or json
+	File       string            `yaml:"file"`        // Empty writes to stdout
+	MaxSize    int               `yaml:"max_size"`    // MB of file before rotation, 0 never rotates
+	MaxBackups int               `yaml:"max_backups"` // Rotated files kept
+	Levels     map[string]string `yaml:"levels"`      // Level of package, like dispatcher: debug
+}
+
+// Config broker config
+type Config struct {
+	LogLevel        string        `yaml:"log_level"`
+	Log             Log           `yaml:"log"`
+	Workers         int           `yaml:"workers"`
+	WorkInQueue     bool          `yaml:"work_in_queue"`
+	MaxClients      int           `yaml:"max_clients"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	Store           string        `yaml:"store"`        // Empty keeps state in memory only
+	StoreSync       time.Duration `yaml:"store_sync"`   // Interval to sync store file, 0 syncs every write
+	SysInterval     time.Duration `yaml:"sys_interval"` // Interval of $SYS topics, 0 disables them
+	Queue           Queue         `yaml:"queue"`
+
+	Listener   Listener   `yaml:"listener"`
+	TLS        TLS        `yaml:"tls"`
+	WebSocket  WebSocket  `yaml:"websocket"`
+	UDP        UDP        `yaml:"udp"`
+	Admin      Admin      `yaml:"admin"`
+	Auth       Auth       `yaml:"auth"`
+	ACL        ACL        `yaml:"acl"`
+	DeviceView DeviceView `yaml:"deviceview"`
+	Metrics    Metrics    `yaml:"metrics"`
+}
+
+// Default config
+func Default() *Config {
+	return &Config{
+		LogLevel: "warning",
+		Log: Log{
+			Format:     mlog.FormatText,
+			MaxSize:    100,
+			MaxBackups: 5,
+			Levels:     make(map[string]string),
+		},
+		Workers:         15,
+		WorkInQueue:     true,
+		MaxClients:      service.DefaultCidCapacity,
+		ShutdownTimeout: 10 * time.Second,
+		SysInterval:     10 * time.Second,
+		Queue: Queue{
+			MaxMessages: 1000,
+			MaxBytes:    16 << 20,
+			Expiry:      24 * time.Hour,
+		},
+
+		Listener: Listener{
+			Net:  "tcp4",
+			Port: 1883,
+		},
+		TLS: TLS{
+			Cert:         "server.crt",
+			Key:          "server.key",
+			MinVersion:   "1.2",
+			VerifyClient: service.VerifyNone,
+		},
+		WebSocket: WebSocket{
+			Path: "/mqtt",
+		},
+		UDP: UDP{
+			Idle: 120 * time.Second,
+		},
+		Auth: Auth{
+			File:    "passwd",
+			Timeout: 3 * time.Second,
+		},
+		ACL: ACL{
+			Reload: 5 * time.Second,
+		},
+		DeviceView: DeviceView{
+			Addr: ":1888",
+		},
+	}
+}
+
+// Load read YAML file over config, settings not in file are kept
+func (c *Config) Load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	return nil
+}
+
+// Shown in place of secrets when config is dumped
+const redacted = "***"
+
+// Redact user info and query values of URL, they may carry credentials
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return redacted
+	}
+
+	user := u.User != nil
+	u.User = nil
+
+	if len(u.RawQuery) > 0 {
+		var keys []string
+		for key := range u.Query() {
+			keys = append(keys, url.QueryEscape(key)+"="+redacted)
+		}
+		sort.Strings(keys)
+		u.RawQuery = strings.Join(keys, "&")
+	}
+
+	// URL escapes "*" of user info
+	if user {
+		return strings.Replace(u.String(), "//", "//"+redacted+"@", 1)
+	}
+
+	return u.String()
+}
+
+// Copy of auth with URL redacted, nil stays nil
+func redactAuth(a *Auth) *Auth {
+	if a == nil {
+		return nil
+	}
+
+	shown := *a
+	shown.URL = redactURL(a.URL)
+
+	return &shown
+}
+
+// String dump config as YAML, secrets are redacted
+func (c *Config) String() string {
+	shown := *c
+	if len(shown.DeviceView.Token) > 0 {
+		shown.DeviceView.Token = redacted
+	}
+
+	shown.Auth = *redactAuth(&c.Auth)
+	shown.Listener.Auth = redactAuth(c.Listener.Auth)
+	shown.TLS.Auth = redactAuth(c.TLS.Auth)
+	shown.WebSocket.Auth = redactAuth(c.WebSocket.Auth)
+	shown.UDP.Auth = redactAuth(c.UDP.Auth)
+
+	data, err := yaml.Marshal(&shown)
+	if err != nil {
+		return err.Error()
+	}
+
+	return string(data)
+}
+
+// Validate check all settings, error lists every invalid one
+func (c *Config) Validate() error {
+	var errs []string
+	check := func(ok bool, format string, v ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, v...))
+		}
+	}
+	checkPort := func(name string, port int, required bool) {
+		if required {
+			check((port > 0) && (port <= 65535), "%s must be 1 to 65535, got %d", name, port)
+		} else {
+			check((port >= 0) && (port <= 65535), "%s must be 0 to 65535, got %d", name, port)
+		}
+	}
+	checkBind := func(name string, bind string) {
+		check((len(bind) == 0) || (net.ParseIP(bind) != nil), "%s must be an IP address, got %q", name, bind)
+	}
+	checkAuth := func(name string, a *Auth, listener bool) {
+		if a == nil {
+			return
+		}
+
+		switch a.Type {
+		case "":
+		case "file":
+			check(len(a.File) > 0, "%s.file is required for file authenticator", name)
+		case "http":
+			check(len(a.URL) > 0, "%s.url is required for http authenticator", name)
+		default:
+			check(false, "%s.type must be file, http or empty, got %q", name, a.Type)
+		}
+
+		if listener {
+			check(a.Timeout >= 0, "%s.timeout must not be negative", name)
+		} else if a.Type == "http" {
+			check(a.Timeout > 0, "%s.timeout must be positive, got %v", name, a.Timeout)
+		}
+	}
+
+	_, exist := mlog.LevelByName(c.LogLevel)
+	check(exist, "log_level must be debug, info, warning or error, got %q", c.LogLevel)
+	check((c.Log.Format == mlog.FormatText) || (c.Log.Format == mlog.FormatJSON),
+		"log.format must be text or json, got %q", c.Log.Format)
+	check(c.Log.MaxSize >= 0, "log.max_size must not be negative")
+	check(c.Log.MaxBackups >= 0, "log.max_backups must not be negative")
+	for pkg, level := range c.Log.Levels {
+		_, exist := mlog.LevelByName(level)
+		check(exist, "log.levels.%s must be debug, info, warning or error, got %q", pkg, level)
+	}
+	check(c.Workers > 0, "workers must be positive, got %d", c.Workers)
+	check(c.MaxClients > 0, "max_clients must be positive, got %d", c.MaxClients)
+	check(c.ShutdownTimeout > 0, "shutdown_timeout must be positive, got %v", c.ShutdownTimeout)
+	check(c.StoreSync >= 0, "store_sync must not be negative")
+	check(c.SysInterval >= 0, "sys_interval must not be negative")
+	check(c.Queue.MaxMessages > 0, "queue.max_messages must be positive, got %d", c.Queue.MaxMessages)
+	check(c.Queue.MaxBytes >= 0, "queue.max_bytes must not be negative")
+	check(c.Queue.Expiry >= 0, "queue.expiry must not be negative")
+
+	check((c.Listener.Net == "tcp") || (c.Listener.Net == "tcp4") || (c.Listener.Net == "tcp6"),
+		"listener.net must be tcp, tcp4 or tcp6, got %q", c.Listener.Net)
+	checkBind("listener.bind", c.Listener.Bind)
+	checkPort("listener.port", c.Listener.Port, true)
+	check(c.Listener.MaxConns >= 0, "listener.max_conns must not be negative")
+	checkAuth("listener.auth", c.Listener.Auth, true)
+
+	checkBind("tls.bind", c.TLS.Bind)
+	checkPort("tls.port", c.TLS.Port, false)
+	check(c.TLS.MaxConns >= 0, "tls.max_conns must not be negative")
+	checkAuth("tls.auth", c.TLS.Auth, true)
+	if c.TLS.Port > 0 {
+		check(len(c.TLS.Cert) > 0, "tls.cert is required")
+		check(len(c.TLS.Key) > 0, "tls.key is required")
+
+		switch c.TLS.MinVersion {
+		case "1.0", "1.1", "1.2", "1.3":
+		default:
+			check(false, "tls.min_version must be 1.0, 1.1, 1.2 or 1.3, got %q", c.TLS.MinVersion)
+		}
+
+		switch c.TLS.VerifyClient {
+		case service.VerifyNone:
+		case service.VerifyOptional, service.VerifyRequire:
+			check(len(c.TLS.ClientCA) > 0, "tls.client_ca is required to verify client certificate")
+		default:
+			check(false, "tls.verify_client must be none, optional or require, got %q", c.TLS.VerifyClient)
+		}
+
+		check(!c.TLS.CertUsername || (c.TLS.VerifyClient != service.VerifyNone),
+			"tls.cert_username needs tls.verify_client optional or require")
+	}
+
+	checkBind("websocket.bind", c.WebSocket.Bind)
+	checkPort("websocket.port", c.WebSocket.Port, false)
+	check(c.WebSocket.MaxConns >= 0, "websocket.max_conns must not be negative")
+	checkAuth("websocket.auth", c.WebSocket.Auth, true)
+	if c.WebSocket.Port > 0 {
+		check(strings.HasPrefix(c.WebSocket.Path, "/"), "websocket.path must start with /, got %q", c.WebSocket.Path)
+	}
+
+	checkBind("udp.bind", c.UDP.Bind)
+	checkPort("udp.port", c.UDP.Port, false)
+	check(c.UDP.MaxConns >= 0, "udp.max_conns must not be negative")
+	checkAuth("udp.auth", c.UDP.Auth, true)
+	if c.UDP.Port > 0 {
+		check(c.UDP.Idle > 0, "udp.idle must be positive, got %v", c.UDP.Idle)
+	}
+
+	checkPort("admin.port", c.Admin.Port, false)
+
+	// TCP ports of listeners must differ
+	ports := map[int]string{c.Listener.Port: "listener.port"}
+	for _, p := range []struct {
+		name string
+		port int
+	}{
+		{"tls.port", c.TLS.Port},
+		{"websocket.port", c.WebSocket.Port},
+		{"admin.port", c.Admin.Port},
+	} {
+		if p.port == 0 {
+			continue
+		}
+		if other, exist := ports[p.port]; exist {
+			check(false, "%s %d is used by %s", p.name, p.port, other)
+			continue
+		}
+		ports[p.port] = p.name
+	}
+
+	checkAuth("auth", &c.Auth, false)
+
+	check(c.ACL.Reload >= 0, "acl.reload must not be negative")
+
+	check((len(c.Metrics.Addr) == 0) || (c.Metrics.Addr != c.DeviceView.Addr),
+		"metrics.addr %s is used by deviceview.addr", c.Metrics.Addr)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config:\n  %s", strings.Join(errs, "\n  "))
+	}
+
+	return nil
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Report result of config reload
+type Report struct {
+	Applied  []string `json:"applied"`            // Settings applied live
+	Restart  []string `json:"restart"`            // Settings changed but need restart
+	Deferred []string `json:"deferred,omitempty"` // Applied settings waiting for connections to close
+}
+
+// Flatten config to map of setting key, like "tls.port", to value
+func (c *Config) flatten() map[string]string {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return nil
+	}
+
+	tree := make(map[string]interface{})
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return nil
+	}
+
+	settings := make(map[string]string)
+
+	var walk func(prefix string, v interface{})
+	walk = func(prefix string, v interface{}) {
+		sub, ok := v.(map[interface{}]interface{})
+		if !ok {
+			settings[prefix] = fmt.Sprint(v)
+			return
+		}
+
+		for k, child := range sub {
+			walk(prefix+"."+fmt.Sprint(k), child)
+		}
+	}
+
+	for k, v := range tree {
+		walk(k, v)
+	}
+
+	return settings
+}
+
+// Diff get keys of settings different in other config, sorted
+func (c *Config) Diff(other *Config) []string {
+	a := c.flatten()
+	b := other.flatten()
+
+	var keys []string
+	for k, v := range a {
+		if b[k] != v {
+			keys = append(keys, k)
+		}
+	}
+	for k := range b {
+		if _, exist := a[k]; !exist {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,297 @@
+package deviceview
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"lwmq/dispatcher"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// Default and max page size of client list
+const (
+	defaultLimit = 100
+	maxLimit     = 1000
+)
+
+// Client list page
+type clientPage struct {
+	Total   int                      `json:"total"` // Clients matching filter
+	Offset  int                      `json:"offset"`
+	Limit   int                      `json:"limit"`
+	Clients []*dispatcher.ClientInfo `json:"clients"`
+}
+
+// Body of subscription request
+type subscribeRequest struct {
+	Topic string `json:"topic"`
+	Qos   byte   `json:"qos"`
+}
+
+// Body of publish request, payload is text unless encoding is base64
+type publishRequest struct {
+	Topic    string `json:"topic"`
+	Payload  string `json:"payload"`
+	Encoding string `json:"encoding"`
+	Qos      byte   `json:"qos"`
+	Retain   bool   `json:"retain"`
+}
+
+// Error response body
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// Write JSON error
+func fail(c echo.Context, code int, msg string) error {
+	return c.JSON(code, &apiError{Error: msg})
+}
+
+// Write JSON error of dispatcher status
+func failStatus(c echo.Context, sts uint32) error {
+	switch sts {
+	case dispatcher.NotFound:
+		return fail(c, http.StatusNotFound, "client not found")
+	case dispatcher.ConnErr:
+		return fail(c, http.StatusConflict, "client not connected")
+	case dispatcher.ArgumentError:
+		return fail(c, http.StatusBadRequest, "invalid topic or qos")
+	}
+
+	return fail(c, http.StatusInternalServerError, "status "+strconv.Itoa(int(sts)))
+}
+
+// Cookie of token set by pages, browsers cannot send header on navigation
+const tokenCookie = "lwmq_token"
+
+// Check bearer token of request, or access_token query parameter of
+// EventSource which cannot set header, or token cookie of pages
+func tokenAuth(token string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			var given string
+			if header := c.Request().Header.Get(echo.HeaderAuthorization); len(header) > 0 {
+				if !strings.HasPrefix(header, "Bearer ") {
+					return fail(c, http.StatusUnauthorized, "invalid token")
+				}
+				given = strings.TrimPrefix(header, "Bearer ")
+			} else if query := c.QueryParam("access_token"); len(query) > 0 {
+				given = query
+			} else if cookie, err := c.Cookie(tokenCookie); err == nil {
+				given = cookie.Value
+			}
+
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				return fail(c, http.StatusUnauthorized, "invalid token")
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// Check token of page, page opened with access_token query parameter keeps
+// it in cookie for later pages and API calls of scripts
+func pageAuth(token string) echo.MiddlewareFunc {
+	auth := tokenAuth(token)
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return auth(func(c echo.Context) error {
+			if subtle.ConstantTimeCompare([]byte(c.QueryParam("access_token")), []byte(token)) == 1 {
+				c.SetCookie(&http.Cookie{
+					Name:     tokenCookie,
+					Value:    token,
+					Path:     "/",
+					HttpOnly: true,
+					SameSite: http.SameSiteStrictMode,
+				})
+			}
+
+			return next(c)
+		})
+	}
+}
+
+// Client ID in path, it may be escaped
+func clientID(c echo.Context) string {
+	id, err := url.PathUnescape(c.Param("id"))
+	if err != nil {
+		return c.Param("id")
+	}
+
+	return id
+}
+
+// Read int query parameter
+func queryInt(c echo.Context, name string, value int) (int, bool) {
+	s := c.QueryParam(name)
+	if len(s) == 0 {
+		return value, true
+	}
+
+	n, err := strconv.Atoi(s)
+	if (err != nil) || (n < 0) {
+		return 0, false
+	}
+
+	return n, true
+}
+
+// GET /api/clients, filters: status online or offline, prefix of client ID,
+// username, listener; paging: offset, limit
+func listClients(c echo.Context) error {
+	offset, ok := queryInt(c, "offset", 0)
+	if !ok {
+		return fail(c, http.StatusBadRequest, "invalid offset")
+	}
+
+	limit, ok := queryInt(c, "limit", defaultLimit)
+	if !ok || (limit == 0) || (limit > maxLimit) {
+		return fail(c, http.StatusBadRequest, "limit must be 1 to "+strconv.Itoa(maxLimit))
+	}
+
+	status := c.QueryParam("status")
+	if (len(status) > 0) && (status != "online") && (status != "offline") {
+		return fail(c, http.StatusBadRequest, "status must be online or offline")
+	}
+	prefix := c.QueryParam("prefix")
+	username := c.QueryParam("username")
+	listener := c.QueryParam("listener")
+
+	var matched []*dispatcher.ClientInfo
+	for _, info := range dispatcher.Mserver.Clients() {
+		if ((status == "online") && !info.Connected) || ((status == "offline") && info.Connected) {
+			continue
+		}
+		if !strings.HasPrefix(info.ClientID, prefix) {
+			continue
+		}
+		if (len(username) > 0) && (info.Username != username) {
+			continue
+		}
+		if (len(listener) > 0) && (info.Listener != listener) {
+			continue
+		}
+		matched = append(matched, info)
+	}
+
+	page := &clientPage{
+		Total:   len(matched),
+		Offset:  offset,
+		Limit:   limit,
+		Clients: []*dispatcher.ClientInfo{},
+	}
+	if offset < len(matched) {
+		end := offset + limit
+		if end > len(matched) {
+			end = len(matched)
+		}
+		page.Clients = matched[offset:end]
+	}
+
+	return c.JSON(http.StatusOK, page)
+}
+
+// GET /api/clients/:id, session with subscriptions and in-flight messages
+func getClient(c echo.Context) error {
+	info, exist := dispatcher.Mserver.Client(clientID(c))
+	if !exist {
+		return failStatus(c, dispatcher.NotFound)
+	}
+
+	return c.JSON(http.StatusOK, info)
+}
+
+// POST /api/clients/:id/disconnect, close connection of client
+func disconnectClient(c echo.Context) error {
+	if sts := dispatcher.Mserver.Kick(clientID(c)); sts != dispatcher.Success {
+		return failStatus(c, sts)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// POST /api/clients/:id/subscriptions, subscribe on behalf of client
+func addSubscription(c echo.Context) error {
+	req := &subscribeRequest{}
+	if err := c.Bind(req); err != nil {
+		return fail(c, http.StatusBadRequest, err.Error())
+	}
+
+	if sts := dispatcher.Mserver.Subscribe(clientID(c), req.Topic, req.Qos); sts != dispatcher.Success {
+		return failStatus(c, sts)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// DELETE /api/clients/:id/subscriptions?topic=filter, unsubscribe on behalf of client
+func delSubscription(c echo.Context) error {
+	topic := c.QueryParam("topic")
+	if len(topic) == 0 {
+		return fail(c, http.StatusBadRequest, "topic is required")
+	}
+
+	if sts := dispatcher.Mserver.Unsubscribe(clientID(c), topic); sts != dispatcher.Success {
+		return failStatus(c, sts)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// POST /api/publish, publish message of broker
+func publish(c echo.Context) error {
+	req := &publishRequest{}
+	if err := c.Bind(req); err != nil {
+		return fail(c, http.StatusBadRequest, err.Error())
+	}
+
+	payload := []byte(req.Payload)
+	switch req.Encoding {
+	case "":
+	case "base64":
+		data, err := base64.StdEncoding.DecodeString(req.Payload)
+		if err != nil {
+			return fail(c, http.StatusBadRequest, "invalid base64 payload")
+		}
+		payload = data
+	default:
+		return fail(c, http.StatusBadRequest, "encoding must be base64 or empty")
+	}
+
+	pub := &dispatcher.PubTopic{
+		Topic:   req.Topic,
+		Qos:     req.Qos,
+		Retain:  req.Retain,
+		Payload: payload,
+	}
+	if sts := dispatcher.Mserver.Publish(pub); sts != dispatcher.Success {
+		return failStatus(c, sts)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Add REST API routes and event stream, empty token disables them
+func addAPI(e *echo.Echo, token string) {
+	if len(token) == 0 {
+		return
+	}
+
+	// Sessions of event stream carry the same data as /api/clients
+	e.GET("/events", events, tokenAuth(token))
+
+	api := e.Group("/api", tokenAuth(token))
+	api.GET("/clients", listClients)
+	api.GET("/clients/:id", getClient)
+	api.POST("/clients/:id/disconnect", disconnectClient)
+	api.POST("/clients/:id/subscriptions", addSubscription)
+	api.DELETE("/clients/:id/subscriptions", delSubscription)
+	api.POST("/publish", publish)
+	api.GET("/topics", listTopics)
+	api.GET("/tail", tail)
+}
@@ -0,0 +1,74 @@
+package deviceview
+
+import (
+	"embed"
+	"errors"
+	"html/template"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Templates and static files built into binary
+//
+//go:embed html
+var embedded embed.FS
+
+// Files of override directory replace embedded ones with the same name
+type overlayFS struct {
+	dir  fs.FS // nil if no override directory
+	base fs.FS
+}
+
+// Open open file of override directory, or embedded one if not exist
+func (o *overlayFS) Open(name string) (fs.File, error) {
+	if o.dir != nil {
+		f, err := o.dir.Open(name)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	return o.base.Open(name)
+}
+
+// Load assets, templates of override directory redefine embedded ones of the
+// same name, empty dir uses embedded assets only
+func loadAssets(dir string) (fs.FS, *template.Template, error) {
+	base, err := fs.Sub(embedded, "html")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	t, err := template.ParseFS(base, "*.html")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(dir) == 0 {
+		return base, t, nil
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !info.IsDir() {
+		return nil, nil, errors.New(dir + " is not a directory")
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(files) > 0 {
+		if t, err = t.ParseFiles(files...); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return &overlayFS{dir: os.DirFS(dir), base: base}, t, nil
+}
@@ -1,21 +1,27 @@
 package deviceview
 
 import (
+	"html/template"
 	"io"
+	"io/fs"
 	"lwmq/dispatcher"
+	"lwmq/metrics"
+	"lwmq/mlog"
 	"net/http"
-	"sort"
 	"strconv"
-	"text/template"
+	"time"
 
 	"github.com/labstack/echo"
 )
 
+var logger = mlog.New("deviceview")
+
 type deviceInfo struct {
 	Odd      int
 	ClientID string
-	Sublist  string
+	Sublist  []string
 	CreateT  string
+	LastSeen string
 	Online   int
 }
 
@@ -33,30 +39,21 @@ var templates *Template
 
 func devicelist(c echo.Context) error {
 
-	var sceneList []string
 	var deviceList []*deviceInfo
 
-	for k := range dispatcher.Mserver.Mclients {
-		sceneList = append(sceneList, k)
-	}
-	sort.Strings(sceneList)
-
-	for idx, k := range sceneList {
-
-		v := dispatcher.Mserver.Mclients[k]
+	for idx, v := range dispatcher.Mserver.Clients() {
 		devinfo := &deviceInfo{
-			ClientID: k,
+			ClientID: v.ClientID,
 			CreateT:  v.CreateTime,
+			LastSeen: "-",
+		}
+		if v.LastSeen > 0 {
+			devinfo.LastSeen = time.Unix(v.LastSeen, 0).Format("15:04:05")
 		}
 
-		showData := ""
-		if v.SubList.Len() > 0 {
-			for j := v.SubList.Front(); j != nil; j = j.Next() {
-				subscribe := j.Value.(*dispatcher.SubTopic)
-				showData += "Topic:" + subscribe.Topic + "   Qos:" + strconv.Itoa(int(subscribe.Qos)) + "<br/>"
-			}
+		for _, subscribe := range v.Subscriptions {
+			devinfo.Sublist = append(devinfo.Sublist, "Topic:"+subscribe.Topic+"   Qos:"+strconv.Itoa(int(subscribe.Qos)))
 		}
-		devinfo.Sublist = showData
 
 		if (idx % 2) == 0 {
 			devinfo.Odd = 1
@@ -64,7 +61,7 @@ func devicelist(c echo.Context) error {
 			devinfo.Odd = 0
 		}
 
-		if v.Status == dispatcher.Connected {
+		if v.Connected {
 			devinfo.Online = 1
 		} else {
 			devinfo.Online = 0
@@ -76,24 +73,49 @@ func devicelist(c echo.Context) error {
 	return c.Render(http.StatusOK, "devices", deviceList)
 }
 
-func getdevices() {
+func getdevices(addr string, static http.FileSystem, token string) {
 	e := echo.New()
-	e.Static("/", "html")
+	e.GET("/static/*", echo.WrapHandler(http.StripPrefix("/static/", http.FileServer(static))))
 
 	e.Renderer = templates
 
-	e.GET("/", devicelist)
+	// Pages and metrics show clients and topics, they need token if it is set
+	var pageAuths, metricsAuths []echo.MiddlewareFunc
+	if len(token) > 0 {
+		pageAuths = append(pageAuths, pageAuth(token))
+		metricsAuths = append(metricsAuths, tokenAuth(token))
+	}
 
-	e.Start(":1888")
-}
+	e.GET("/", devicelist, pageAuths...)
+	e.GET("/topics", topicsPage, pageAuths...)
+	e.GET("/metrics", echo.WrapHandler(metrics.Default), metricsAuths...)
+	addAPI(e, token)
 
-// Startservice start http service
-func Startservice() {
-	go getdevices()
+	if err := e.Start(addr); err != nil {
+		logger.Error("Device view stopped", "addr", addr, "error", err)
+	}
 }
 
-func init() {
+// Startservice start http service on addr, templates and static files are
+// built in, files in htmlDir replace them if it is not empty, only files
+// under static/ are served as they are. Pages, metrics, REST API under /api
+// and event stream need token, empty token disables API and event stream
+func Startservice(addr string, htmlDir string, token string) error {
+	assets, t, err := loadAssets(htmlDir)
+	if err != nil {
+		return err
+	}
+
 	templates = &Template{
-		templates: template.Must(template.ParseGlob("html/*.html")),
+		templates: t,
 	}
+
+	static, err := fs.Sub(assets, "static")
+	if err != nil {
+		return err
+	}
+
+	go getdevices(addr, http.FS(static), token)
+
+	return nil
 }
@@ -0,0 +1,67 @@
+package deviceview
+
+import (
+	"encoding/json"
+	"fmt"
+	"lwmq/dispatcher"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Interval of client list sent to event stream, page computes rates from it
+const snapshotInterval = 2 * time.Second
+
+// Write one server-sent event
+func writeEvent(w *echo.Response, name string, data interface{}) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, body); err != nil {
+		return err
+	}
+	w.Flush()
+
+	return nil
+}
+
+// GET /events?access_token=token, server-sent events of clients: "clients"
+// with all sessions every snapshotInterval, and connect, disconnect, remove,
+// subscribe and unsubscribe as they happen
+func events(c echo.Context) error {
+	events, stop := dispatcher.Mserver.Watch()
+	defer stop()
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	if err := writeEvent(w, "clients", dispatcher.Mserver.Clients()); err != nil {
+		return nil
+	}
+
+	ticker := time.NewTicker(snapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		var err error
+
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case e := <-events:
+			err = writeEvent(w, e.Type, e)
+		case <-ticker.C:
+			err = writeEvent(w, "clients", dispatcher.Mserver.Clients())
+		}
+
+		// Connection closed by browser
+		if err != nil {
+			return nil
+		}
+	}
+}
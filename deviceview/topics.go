@@ -0,0 +1,63 @@
+package deviceview
+
+import (
+	"lwmq/dispatcher"
+	"net/http"
+
+	"github.com/labstack/echo"
+)
+
+// Message of tail, payload is base64 in JSON
+type tailMessage struct {
+	Topic   string `json:"topic"`
+	Payload []byte `json:"payload"`
+	Qos     byte   `json:"qos"`
+	Retain  bool   `json:"retain"`
+	Time    int64  `json:"time"`
+}
+
+// GET /topics, topic browser page
+func topicsPage(c echo.Context) error {
+	return c.Render(http.StatusOK, "topics", nil)
+}
+
+// GET /api/topics, recent topics and topics with retained message
+func listTopics(c echo.Context) error {
+	return c.JSON(http.StatusOK, dispatcher.Mserver.Topics())
+}
+
+// GET /api/tail?filter=a/%23, server-sent "message" events of publishes
+// matching topic filter
+func tail(c echo.Context) error {
+	messages, stop, ok := dispatcher.Mserver.Tail(c.QueryParam("filter"))
+	if !ok {
+		return fail(c, http.StatusBadRequest, "invalid topic filter")
+	}
+	defer stop()
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	w.Flush()
+
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case m := <-messages:
+			msg := &tailMessage{
+				Topic:   m.Topic,
+				Payload: m.Payload,
+				Qos:     m.Qos,
+				Retain:  m.Retain,
+				Time:    m.Time,
+			}
+
+			// Connection closed by browser
+			if err := writeEvent(w, "message", msg); err != nil {
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package dispatcher
+
+import (
+	"lwmq/iface"
+	"lwmq/mtopic"
+)
+
+// Get session of client ID
+func (s *MQTTserver) getSession(clientID string) *MQTTClient {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+
+	return s.Mclients[clientID]
+}
+
+// Kick close connection of client, it is handled as lost connection, will
+// message is published and persistent session is kept offline
+func (s *MQTTserver) Kick(clientID string) uint32 {
+	s.Lock.Lock()
+	mc, exist := s.Mclients[clientID]
+	var cl iface.Iclient
+	if exist && (mc.Status == Connected) {
+		cl = mc.ConnClient
+	}
+	s.Lock.Unlock()
+
+	if !exist {
+		return NotFound
+	}
+
+	if cl == nil {
+		return ConnErr
+	}
+
+	logger.Warning("Kick client", "clientid", clientID, "cid", cl.GetCid())
+	cl.Stop()
+
+	return Success
+}
+
+// Subscribe add subscription to session of client, ACL is not checked,
+// retained messages are delivered like SUBSCRIBE of client
+func (s *MQTTserver) Subscribe(clientID string, filter string, qos byte) uint32 {
+	if !mtopic.ValidFilter(filter) || (qos > 2) {
+		return ArgumentError
+	}
+
+	mc := s.getSession(clientID)
+	if mc == nil {
+		return NotFound
+	}
+
+	mc.AddSubscribe(&SubTopic{Topic: filter, Qos: qos})
+	s.SubIndex.Subscribe(clientID, filter, qos)
+	s.emit(EventSubscribe, clientID, filter, qos)
+	s.saveSession(mc)
+
+	return s.PubRetained(mc, filter, qos)
+}
+
+// Unsubscribe remove subscription from session of client
+func (s *MQTTserver) Unsubscribe(clientID string, filter string) uint32 {
+	mc := s.getSession(clientID)
+	if mc == nil {
+		return NotFound
+	}
+
+	mc.DelSubscribe(filter)
+	s.SubIndex.Unsubscribe(clientID, filter)
+	s.emit(EventUnsubscribe, clientID, filter, 0)
+	s.saveSession(mc)
+
+	return Success
+}
+
+// Publish publish message of broker to subscribers, ACL is not checked
+func (s *MQTTserver) Publish(pub *PubTopic) uint32 {
+	if !mtopic.ValidName(pub.Topic) || isSysTopic(pub.Topic) || (pub.Qos > 2) {
+		return ArgumentError
+	}
+
+	if pub.Retain {
+		s.StoreRetain(pub)
+	}
+
+	return s.PubToClient(pub)
+}
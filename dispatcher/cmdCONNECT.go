@@ -2,8 +2,10 @@ package dispatcher
 
 import (
 	"container/list"
+	"lwmq/auth"
 	"lwmq/iface"
 	"lwmq/mlog"
+	"lwmq/mtopic"
 	"sync"
 	"time"
 )
@@ -11,15 +13,34 @@ import (
 func respCONNACK(cl iface.Iclient, resp1 byte, resp2 byte) uint32 {
 	var resp = []byte{CONNACK << 4, 0x02, resp1, resp2}
 
-	cl.Send(resp, 4)
+	sendPacket(cl, resp)
 
 	return Success
 }
 
+// Read length prefixed field of payload, return field and next offset
+func readField(buff []byte, offset uint32, end uint32) ([]byte, uint32, uint32) {
+	if offset+2 > end {
+		return nil, offset, LenError
+	}
+
+	fieldLen := uint32(buff[offset])<<8 + uint32(buff[offset+1])
+	if offset+2+fieldLen > end {
+		return nil, offset, LenError
+	}
+
+	return buff[offset+2 : offset+2+fieldLen], offset + 2 + fieldLen, Success
+}
+
 // HandleCONNECT handle CONNECT command
 func HandleCONNECT(cl iface.Iclient, buff []byte, size uint32) uint32 {
 	mlog.Debug("CONNECT")
 
+	result := connectInvalid
+	defer func() {
+		connects.With(result).Inc()
+	}()
+
 	var resp1 byte = 0
 	var resp2 byte = 0
 
@@ -61,42 +82,125 @@ func HandleCONNECT(cl iface.Iclient, buff []byte, size uint32) uint32 {
 	connectFlag := buff[varStart+2+protocolLen+1]
 	keepAlive := uint32(buff[varStart+2+protocolLen+2])<<8 + uint32(buff[varStart+2+protocolLen+3])
 
+	// Will Qos and will retain must be 0 if no will flag, MQTT-3.1.2-13
+	willFlag := (connectFlag & 0x04) != 0
+	willQos := (connectFlag >> 3) & 0x03
+	willRetain := (connectFlag & 0x20) != 0
+	if willQos == 0x03 || (!willFlag && (willQos != 0 || willRetain)) {
+		return ArgumentError
+	}
+
 	// Check payload
 	payloadStart := varStart + 2 + protocolLen + 4
-	clientIDLen := uint32(buff[payloadStart])<<8 + uint32(buff[payloadStart+1])
+	payloadEnd := 1 + leftLenSize + leftLen
+	field, next, sts := readField(buff, payloadStart, payloadEnd)
+	if sts != Success {
+		return sts
+	}
 	// TODO: zero byte client ID
-	clientID := string(buff[payloadStart+2 : payloadStart+2+clientIDLen])
+	clientID := string(field)
+
+	var willTopic string
+	var willMessage []byte
+	if willFlag {
+		field, next, sts = readField(buff, next, payloadEnd)
+		if sts != Success {
+			return sts
+		}
+		willTopic = string(field)
+
+		if !mtopic.ValidName(willTopic) {
+			return ArgumentError
+		}
+
+		willMessage, next, sts = readField(buff, next, payloadEnd)
+		if sts != Success {
+			return sts
+		}
+	}
+
+	// Password without user name is not allowed, MQTT-3.1.2-22
+	userFlag := (connectFlag & 0x80) != 0
+	passwordFlag := (connectFlag & 0x40) != 0
+	if passwordFlag && !userFlag {
+		return ArgumentError
+	}
+
+	var username string
+	var password []byte
+	if userFlag {
+		field, next, sts = readField(buff, next, payloadEnd)
+		if sts != Success {
+			return sts
+		}
+		username = string(field)
+	}
 
-	// TODO: Will topic, user name, password
+	if passwordFlag {
+		password, _, sts = readField(buff, next, payloadEnd)
+		if sts != Success {
+			return sts
+		}
+	}
 
-	mlog.Debug("Protocol Name:", protocolName)
-	mlog.Debug("Connect flag:", connectFlag)
-	mlog.Debug("Keep alive:", keepAlive)
-	mlog.Debug("Client ID:", clientID)
+	conn := cl.GetConn()
+	log := logger.With("clientid", clientID, "cid", cl.GetCid(), "remote", conn.GetRemote())
+	log.Debug("Parsed CONNECT", "protocol", protocolName, "flag", connectFlag, "keepalive", keepAlive,
+		"will", willTopic, "user", username)
+
+	// Verified client certificate authenticates the client instead of the
+	// authenticator, its name is the user name checked by ACL
+	certName := conn.GetCertName()
+	if len(certName) > 0 {
+		username = certName
+		log.Debug("Certificate user name", "user", username)
+	}
+
+	// Check user name and password, every listener may have its own authenticator
+	authenticator := Mserver.getAuth(conn.GetListener())
+	if (authenticator != nil) && (len(certName) == 0) {
+		code := authenticator.Authenticate(clientID, username, password)
+		if code != auth.Accepted {
+			log.Warning("Authenticate fail", "user", username, "code", code)
+			if code == auth.BadCredentials {
+				result = connectBadCredentials
+			} else {
+				result = connectNotAuthorized
+			}
+			respCONNACK(cl, 0x00, code)
+
+			return Fail
+		}
+	}
 
 	// Add new client to server
 	mclient := &MQTTClient{
+		ClientID:     clientID,
+		Username:     username,
 		ConnClient:   cl,
 		Status:       Connected,
 		ProtocolName: protocolName,
 		ConnectFlag:  connectFlag,
 		KeepAlive:    keepAlive,
 		SubList:      list.New(),
+		RecvPids:     make(map[uint32]bool),
+		inflight:     make(map[uint32]*WaitAck),
+		WillFlag:     willFlag,
+		WillQos:      willQos,
+		WillRetain:   willRetain,
+		WillTopic:    willTopic,
+		WillMessage:  willMessage,
 		lock:         new(sync.Mutex),
-		LastTime:     0,
+		LastTime:     time.Now().Unix(),
 		CreateTime:   time.Now().Format(time.UnixDate),
 	}
 
-	if keepAlive > 0 {
-		mclient.LastTime = time.Now().Unix()
-	}
-
 	sts = Mserver.AddMQTTClient(clientID, mclient)
 	if sts == ClientExist {
-		if (connectFlag & 0x02) == 0 {
-			resp1 |= 0x01
-		}
+		// Session present, MQTT-3.2.2-2
+		resp1 |= 0x01
 	} else if sts != Success {
+		result = connectRejected
 		resp1 = 0x00
 		resp2 = 0x02
 		respCONNACK(cl, resp1, resp2)
@@ -105,13 +209,23 @@ func HandleCONNECT(cl iface.Iclient, buff []byte, size uint32) uint32 {
 	}
 
 	// Send Response
-	resp1 = 0
 	resp2 = 0
 	sts = respCONNACK(cl, resp1, resp2)
 	if sts != Success {
 		return sts
 	}
 
+	result = connectAccepted
+	log.Info("Client connected", "user", username, "listener", conn.GetListener(), "session", resp1&0x01)
+
+	// Deliver messages queued while session is offline
+	if resp1&0x01 != 0 {
+		session := Mserver.GetMQTTClient(cl)
+		if session != nil {
+			Mserver.ResendInflight(session)
+		}
+	}
+
 	return Success
 }
 
@@ -134,7 +248,17 @@ func HandleDISCONNECT(cl iface.Iclient, buff []byte, size uint32) uint32 {
 
 	clientID := Mserver.GetMQTTClientID(cl)
 	if len(clientID) > 0 {
-		Mserver.DelMQTTClient(clientID)
+		// Normal disconnect, discard will message, MQTT-3.14.4-3
+		mclient := Mserver.GetMQTTClient(cl)
+		if mclient != nil {
+			mclient.ClearWill()
+		}
+
+		// Persistent session is kept offline
+		Mserver.RemoveMQTTClient(clientID)
+		disconnects.With(disconnectNormal).Inc()
+
+		logger.Info("Client disconnected", "clientid", clientID, "cid", cl.GetCid())
 	}
 
 	cl.Stop()
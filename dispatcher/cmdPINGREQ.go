@@ -8,7 +8,7 @@ import (
 func respPINGRESP(cl iface.Iclient) uint32 {
 	var resp = []byte{PINGRESP << 4, 0x00}
 
-	cl.Send(resp, uint32(len(resp)))
+	sendPacket(cl, resp)
 
 	return Success
 }
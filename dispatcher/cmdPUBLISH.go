@@ -3,13 +3,17 @@ package dispatcher
 import (
 	"lwmq/iface"
 	"lwmq/mlog"
+	"lwmq/mtopic"
+	"lwmq/store"
+	"sync/atomic"
 )
 
-func respPUBACK(cl iface.Iclient, pid uint32) uint32 {
+// Response with packet id only, PUBACK, PUBREC, PUBREL and PUBCOMP
+func respPidAck(cl iface.Iclient, command byte, flag byte, pid uint32) uint32 {
 	var resp = []byte{}
 	var pidEncode = []byte{byte(pid >> 8), byte(pid & 0xff)}
 
-	resp = append(resp, PUBACK<<4)
+	resp = append(resp, command<<4|flag)
 
 	respLen := uint32(2)
 	respLenEncode := EncodeLen(respLen)
@@ -17,17 +21,63 @@ func respPUBACK(cl iface.Iclient, pid uint32) uint32 {
 	resp = append(resp, respLenEncode...)
 	resp = append(resp, pidEncode...)
 
-	cl.Send(resp, uint32(len(resp)))
+	sendPacket(cl, resp)
 
 	return Success
 }
 
+func respPUBACK(cl iface.Iclient, pid uint32) uint32 {
+	return respPidAck(cl, PUBACK, 0x00, pid)
+}
+
+func respPUBREC(cl iface.Iclient, pid uint32) uint32 {
+	return respPidAck(cl, PUBREC, 0x00, pid)
+}
+
+func respPUBREL(cl iface.Iclient, pid uint32) uint32 {
+	// MQTT-3.6.1-1, reserved bits of PUBREL are 0010
+	return respPidAck(cl, PUBREL, 0x02, pid)
+}
+
+func respPUBCOMP(cl iface.Iclient, pid uint32) uint32 {
+	return respPidAck(cl, PUBCOMP, 0x00, pid)
+}
+
+// Encode PUBLISH packet send to subscriber
+func encodePUBLISH(pub *PubTopic, qos byte, pid uint32) []byte {
+	var flag = qos << 1
+	if pub.Dup && (qos > 0) {
+		flag |= 0x08
+	}
+	if pub.Retain {
+		flag |= 0x01
+	}
+
+	topicLen := uint32(len(pub.Topic))
+	leftLen := 2 + topicLen + uint32(len(pub.Payload))
+	if qos > 0 {
+		leftLen += 2
+	}
+
+	buff := make([]byte, 0, 5+leftLen)
+	buff = append(buff, PUBLISH<<4|flag)
+	buff = append(buff, EncodeLen(leftLen)...)
+	buff = append(buff, byte(topicLen>>8), byte(topicLen&0xff))
+	buff = append(buff, pub.Topic...)
+	if qos > 0 {
+		buff = append(buff, byte(pid>>8), byte(pid&0xff))
+	}
+	buff = append(buff, pub.Payload...)
+
+	return buff
+}
+
 // HandlePUBLISH handle PUBLISH command
 func HandlePUBLISH(cl iface.Iclient, buff []byte, size uint32) uint32 {
 	mlog.Debug("HandlePUBLISH")
 
 	flag := buff[0] & 0x0f
-	//retain := flag & 0x0f
+	retain := flag & 0x01
 	Qos := (flag & 0x06) >> 1
 	//dup := (flag & 0x08) >> 3
 
@@ -41,7 +91,7 @@ func HandlePUBLISH(cl iface.Iclient, buff []byte, size uint32) uint32 {
 	}
 
 	// Check header
-	leftLenSize, _, sts := DecodeLen(buff, size)
+	leftLenSize, leftLen, sts := DecodeLen(buff, size)
 	if sts != Success {
 		return sts
 	}
@@ -49,24 +99,68 @@ func HandlePUBLISH(cl iface.Iclient, buff []byte, size uint32) uint32 {
 	// Parse header
 	varStart := 1 + leftLenSize
 	topicLen := uint32(buff[varStart])<<8 + uint32(buff[varStart+1])
+	payloadStart := varStart + 2 + topicLen
+	if Qos > 0 {
+		payloadStart += 2
+	}
+	if payloadStart > (varStart + leftLen) {
+		return LenError
+	}
+
 	topic := string(buff[varStart+2 : varStart+2+topicLen])
 
 	mlog.Debug("Publish to:", topic, " Qos:", Qos)
 
+	// Topic name must not contain wildcards
+	if !mtopic.ValidName(topic) {
+		if cl == nil {
+			return ConnErr
+		}
+
+		cl.Stop()
+		return ArgumentError
+	}
+
 	// Parse payload
 	publish := &PubTopic{
-		Topic: topic,
-		Qos:   Qos,
-		Pid:   0,
+		Topic:   topic,
+		Qos:     Qos,
+		Pid:     0,
+		Payload: buff[payloadStart : varStart+leftLen],
 	}
 
 	if Qos > 0 {
 		pid := uint32(buff[varStart+2+topicLen])<<8 + uint32(buff[varStart+2+topicLen+1])
 		publish.Pid = pid
 	}
-	publish.Payload = buff
 
-	Mserver.PubToClient(publish)
+	// Unauthorized publish is acknowledged but dropped
+	var mclient *MQTTClient
+	if cl != nil {
+		mclient = Mserver.GetMQTTClient(cl)
+	}
+	if mclient != nil {
+		atomic.AddUint64(&mclient.msgsIn, 1)
+	}
+
+	if !Mserver.CanPublish(mclient, topic) {
+		mlog.Warning("Publish not authorized, drop:", topic)
+		drops.With(dropNotAuthorized).Inc()
+	} else if (Qos == 2) && (mclient != nil) && !mclient.AddRecvPid(publish.Pid) {
+		// Qos 2 deliver once, resend with same pid before PUBREL is ignored
+		mlog.Debug("Qos 2 duplicate pid:", publish.Pid)
+	} else {
+		if (Qos == 2) && (mclient != nil) {
+			Mserver.saveRecvPid(mclient, publish.Pid)
+		}
+
+		// Replace retained message of topic, empty payload deletes it
+		if retain != 0 {
+			Mserver.StoreRetain(publish)
+		}
+
+		Mserver.PubToClient(publish)
+	}
 
 	if Qos == 1 {
 		if cl == nil {
@@ -78,12 +172,36 @@ func HandlePUBLISH(cl iface.Iclient, buff []byte, size uint32) uint32 {
 			return sts
 		}
 	} else if Qos == 2 {
-		// TODO
+		if cl == nil {
+			return ConnErr
+		}
+
+		sts = respPUBREC(cl, publish.Pid)
+		if sts != Success {
+			return sts
+		}
 	}
 
 	return Success
 }
 
+// Parse packet id of PUBACK, PUBREC, PUBREL and PUBCOMP
+func parsePidAck(buff []byte, size uint32, reserved byte) (uint32, uint32) {
+	flag := buff[0] & 0x0f
+	if flag != reserved {
+		return 0, ArgumentError
+	}
+
+	// Check header
+	if (size < 4) || (buff[1] != 2) {
+		return 0, LenError
+	}
+
+	pid := uint32(buff[2])<<8 + uint32(buff[3])
+
+	return pid, Success
+}
+
 // HandlePUBACK handle PUBACK command
 func HandlePUBACK(cl iface.Iclient, buff []byte, size uint32) uint32 {
 	mlog.Debug("HandlePUBACK")
@@ -92,18 +210,70 @@ func HandlePUBACK(cl iface.Iclient, buff []byte, size uint32) uint32 {
 		return ConnErr
 	}
 
-	flag := buff[0] & 0x0f
-	if flag != 0x00 {
-		return ArgumentError
+	pid, sts := parsePidAck(buff, size, 0x00)
+	if sts != Success {
+		return sts
 	}
 
-	// Check header
-	if buff[1] != 2 {
-		return LenError
+	Mserver.PubAck(cl, pid)
+
+	return Success
+}
+
+// HandlePUBREC handle PUBREC command, subscriber received Qos 2 data
+func HandlePUBREC(cl iface.Iclient, buff []byte, size uint32) uint32 {
+	mlog.Debug("HandlePUBREC")
+
+	if cl == nil {
+		return ConnErr
 	}
 
-	pid := uint32(buff[2])<<8 + uint32(buff[3])
-	Mserver.PubAck(cl, pid)
+	pid, sts := parsePidAck(buff, size, 0x00)
+	if sts != Success {
+		return sts
+	}
+
+	Mserver.PubRec(cl, pid)
+
+	return respPUBREL(cl, pid)
+}
+
+// HandlePUBREL handle PUBREL command, publisher release Qos 2 data
+func HandlePUBREL(cl iface.Iclient, buff []byte, size uint32) uint32 {
+	mlog.Debug("HandlePUBREL")
+
+	if cl == nil {
+		return ConnErr
+	}
+
+	pid, sts := parsePidAck(buff, size, 0x02)
+	if sts != Success {
+		return sts
+	}
+
+	mclient := Mserver.GetMQTTClient(cl)
+	if mclient != nil {
+		mclient.DelRecvPid(pid)
+		Mserver.deleteInflight(mclient, pid, store.Received)
+	}
+
+	return respPUBCOMP(cl, pid)
+}
+
+// HandlePUBCOMP handle PUBCOMP command, subscriber complete Qos 2 data
+func HandlePUBCOMP(cl iface.Iclient, buff []byte, size uint32) uint32 {
+	mlog.Debug("HandlePUBCOMP")
+
+	if cl == nil {
+		return ConnErr
+	}
+
+	pid, sts := parsePidAck(buff, size, 0x00)
+	if sts != Success {
+		return sts
+	}
+
+	Mserver.PubComp(cl, pid)
 
 	return Success
 }
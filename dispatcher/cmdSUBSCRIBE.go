@@ -3,6 +3,7 @@ package dispatcher
 import (
 	"lwmq/iface"
 	"lwmq/mlog"
+	"lwmq/mtopic"
 )
 
 func respSUBACK(cl iface.Iclient, pid uint32, respSub []byte, respCnt uint32) uint32 {
@@ -18,7 +19,7 @@ func respSUBACK(cl iface.Iclient, pid uint32, respSub []byte, respCnt uint32) ui
 	resp = append(resp, pidEncode...)
 	resp = append(resp, respSub...)
 
-	cl.Send(resp, uint32(len(resp)))
+	sendPacket(cl, resp)
 
 	return Success
 }
@@ -50,6 +51,7 @@ func HandleSUBSCRIBE(cl iface.Iclient, buff []byte, size uint32) uint32 {
 	var i uint32
 	var subCnt uint32 = 0
 	var subResp = []byte{}
+	var subList = []*SubTopic{}
 	mclient := Mserver.GetMQTTClient(cl)
 
 	for i = (varStart + 2); i < (1 + leftLenSize + leftLen); {
@@ -61,26 +63,48 @@ func HandleSUBSCRIBE(cl iface.Iclient, buff []byte, size uint32) uint32 {
 			return ArgumentError
 		}
 
+		i += 2 + topicLen + 1
+		subCnt++
+
+		if !mtopic.ValidFilter(topicFilter) {
+			mlog.Warning("Invalid topic filter:", topicFilter)
+			subResp = append(subResp, 0x80)
+			continue
+		}
+
+		if !Mserver.CanSubscribe(mclient, topicFilter) {
+			mlog.Warning("Subscribe not authorized:", topicFilter)
+			subResp = append(subResp, 0x80)
+			continue
+		}
+
 		subscribe := &SubTopic{
 			Topic: topicFilter,
 			Qos:   topicQos,
 		}
 
 		mclient.AddSubscribe(subscribe)
+		Mserver.SubIndex.Subscribe(mclient.ClientID, topicFilter, topicQos)
+		Mserver.emit(EventSubscribe, mclient.ClientID, topicFilter, topicQos)
 		subResp = append(subResp, topicQos)
-		subCnt++
-
-		i += 2 + topicLen + 1
+		subList = append(subList, subscribe)
 
 		mlog.Debug("Len:", topicLen)
 		mlog.Debug("Topic:", topicFilter)
 		mlog.Debug("Qos:", topicQos)
 	}
 
+	Mserver.saveSession(mclient)
+
 	sts = respSUBACK(cl, pid, subResp, subCnt)
 	if sts != Success {
 		return sts
 	}
 
+	// Send retained messages after SUBACK
+	for _, subscribe := range subList {
+		Mserver.PubRetained(mclient, subscribe.Topic, subscribe.Qos)
+	}
+
 	return Success
 }
@@ -17,7 +17,7 @@ func respUNSUBACK(cl iface.Iclient, pid uint32) uint32 {
 	resp = append(resp, respLenEncode...)
 	resp = append(resp, pidEncode...)
 
-	cl.Send(resp, uint32(len(resp)))
+	sendPacket(cl, resp)
 
 	return Success
 }
@@ -53,6 +53,8 @@ func HandleUNSUBSCRIBE(cl iface.Iclient, buff []byte, size uint32) uint32 {
 		topicLen := uint32(buff[i])<<8 + uint32(buff[i+1])
 		topicFilter := string(buff[i+2 : i+2+topicLen])
 		mclient.DelSubscribe(topicFilter)
+		Mserver.SubIndex.Unsubscribe(mclient.ClientID, topicFilter)
+		Mserver.emit(EventUnsubscribe, mclient.ClientID, topicFilter, 0)
 
 		i += 2 + topicLen
 
@@ -60,6 +62,8 @@ func HandleUNSUBSCRIBE(cl iface.Iclient, buff []byte, size uint32) uint32 {
 		mlog.Debug("Topic:", topicFilter)
 	}
 
+	Mserver.saveSession(mclient)
+
 	sts = respUNSUBACK(cl, pid)
 	if sts != Success {
 		return sts
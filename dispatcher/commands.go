@@ -12,6 +12,7 @@ const (
 	ConnErr
 	ConnExist
 	ClientExist
+	NotFound
 )
 
 // Status
@@ -0,0 +1,65 @@
+package dispatcher
+
+import (
+	"time"
+)
+
+// Types of event
+const (
+	EventConnect     = "connect"
+	EventDisconnect  = "disconnect"
+	EventRemove      = "remove" // Session deleted
+	EventSubscribe   = "subscribe"
+	EventUnsubscribe = "unsubscribe"
+)
+
+// Events buffered for one watcher, more are dropped if it is slow
+const eventQueueSize = 256
+
+// Event change of client sent to watchers
+type Event struct {
+	Type     string `json:"type"`
+	ClientID string `json:"client_id"`
+	Topic    string `json:"topic,omitempty"`
+	Qos      byte   `json:"qos"`
+	Time     int64  `json:"time"`
+}
+
+// Watch get events of clients until stop is called, events are dropped
+// if they are not read in time, read snapshots to catch up
+func (s *MQTTserver) Watch() (events <-chan *Event, stop func()) {
+	ch := make(chan *Event, eventQueueSize)
+
+	s.watchLock.Lock()
+	s.watchers[ch] = true
+	s.watchLock.Unlock()
+
+	stop = func() {
+		s.watchLock.Lock()
+		delete(s.watchers, ch)
+		s.watchLock.Unlock()
+	}
+
+	return ch, stop
+}
+
+// Send event to every watcher without blocking
+func (s *MQTTserver) emit(eventType string, clientID string, topic string, qos byte) {
+	e := &Event{
+		Type:     eventType,
+		ClientID: clientID,
+		Topic:    topic,
+		Qos:      qos,
+		Time:     time.Now().Unix(),
+	}
+
+	s.watchLock.Lock()
+	defer s.watchLock.Unlock()
+
+	for ch := range s.watchers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
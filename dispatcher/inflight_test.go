@@ -0,0 +1,130 @@
+package dispatcher
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Connect session and subscribe filter
+func connectSubscribe(t *testing.T, clientID string, persistent bool, filter string, qos byte) *MQTTClient {
+	mc := newTestSession(clientID, persistent)
+	if sts := Mserver.AddMQTTClient(clientID, mc); sts != Success {
+		t.Fatalf("add %s: status %d", clientID, sts)
+	}
+
+	if sts := Mserver.Subscribe(clientID, filter, qos); sts != Success {
+		t.Fatalf("subscribe %s: status %d", clientID, sts)
+	}
+
+	return mc
+}
+
+// Pids of in-flight messages of session
+func inflightPids(t *testing.T, clientID string) map[uint32]bool {
+	info, exist := Mserver.Client(clientID)
+	if !exist {
+		t.Fatalf("session %s not found", clientID)
+	}
+
+	pids := make(map[uint32]bool)
+	for _, inflight := range info.Inflight {
+		pids[inflight.Pid] = true
+	}
+
+	return pids
+}
+
+func TestPidPerSession(t *testing.T) {
+	const prefix = "pid-"
+	defer cleanSessions(t, prefix)
+
+	a := connectSubscribe(t, prefix+"a", false, "pid/#", 1)
+	b := connectSubscribe(t, prefix+"b", false, "pid/b/#", 2)
+
+	// a gets every message, b only the last two
+	for _, topic := range []string{"pid/a", "pid/b/1", "pid/b/2"} {
+		Mserver.PubToClient(&PubTopic{Topic: topic, Qos: 2, Payload: []byte("x")})
+	}
+
+	if got := inflightPids(t, a.ClientID); len(got) != 3 || !got[1] || !got[2] || !got[3] {
+		t.Fatalf("pids of a: %v", got)
+	}
+	if got := inflightPids(t, b.ClientID); len(got) != 2 || !got[1] || !got[2] {
+		t.Fatalf("pids of b: %v", got)
+	}
+
+	// Ack of a does not release same pid of b
+	if sts := Mserver.PubAck(a.ConnClient, 2); sts != Success {
+		t.Fatalf("PUBACK of a: status %d", sts)
+	}
+	if sts := Mserver.PubRec(b.ConnClient, 2); sts != Success {
+		t.Fatalf("PUBREC of b: status %d", sts)
+	}
+	if sts := Mserver.PubAck(b.ConnClient, 2); sts != Fail {
+		t.Fatalf("PUBACK of Qos 2 message: status %d", sts)
+	}
+	if got := inflightPids(t, a.ClientID); len(got) != 2 || got[2] {
+		t.Fatalf("pids of a after PUBACK: %v", got)
+	}
+	if sts := Mserver.PubComp(b.ConnClient, 2); sts != Success {
+		t.Fatalf("PUBCOMP of b: status %d", sts)
+	}
+	if got := inflightPids(t, b.ClientID); len(got) != 1 || !got[1] {
+		t.Fatalf("pids of b after PUBCOMP: %v", got)
+	}
+
+	// Released pid is not reused until pids wrap
+	Mserver.PubToClient(&PubTopic{Topic: "pid/a", Qos: 1, Payload: []byte("x")})
+	if got := inflightPids(t, a.ClientID); len(got) != 3 || !got[4] {
+		t.Fatalf("pids of a after publish: %v", got)
+	}
+}
+
+func TestPidExhausted(t *testing.T) {
+	const prefix = "exhaust-"
+	defer cleanSessions(t, prefix)
+
+	full := connectSubscribe(t, prefix+"full", false, "exhaust/#", 1)
+	other := connectSubscribe(t, prefix+"other", false, "exhaust/#", 1)
+
+	// Every pid of session waits ack
+	Mserver.Lock.Lock()
+	blocked := newWaitAck(&PubTopic{Topic: "exhaust/old", Qos: 1}, 0, time.Now())
+	for i := 0; i < maxPid; i++ {
+		if full.allocPid(blocked) == 0 {
+			Mserver.Lock.Unlock()
+			t.Fatalf("pid %d not allocated", i+1)
+		}
+	}
+	if pid := full.allocPid(blocked); pid != 0 {
+		Mserver.Lock.Unlock()
+		t.Fatalf("pid %d allocated when all are used", pid)
+	}
+	Mserver.Lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			Mserver.PubToClient(&PubTopic{Topic: fmt.Sprintf("exhaust/%d", i), Qos: 1, Payload: []byte("x")})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publish blocked by session without free pid")
+	}
+
+	Mserver.Lock.Lock()
+	fullCount, otherCount := len(full.inflight), len(other.inflight)
+	Mserver.Lock.Unlock()
+
+	if fullCount != maxPid {
+		t.Fatalf("session without free pid has %d in-flight", fullCount)
+	}
+	if otherCount != 10 {
+		t.Fatalf("other session has %d in-flight, want 10", otherCount)
+	}
+}
@@ -0,0 +1,102 @@
+package dispatcher
+
+import (
+	"lwmq/iface"
+	"lwmq/metrics"
+)
+
+// Metrics of MQTT server
+var (
+	packetsIn = metrics.Default.NewCounterVec("lwmq_packets_received_total",
+		"MQTT packets received by type", "type")
+	bytesIn = metrics.Default.NewCounterVec("lwmq_received_bytes_total",
+		"Bytes of MQTT packets received by type", "type")
+	packetsOut = metrics.Default.NewCounterVec("lwmq_packets_sent_total",
+		"MQTT packets sent by type", "type")
+	bytesOut = metrics.Default.NewCounterVec("lwmq_sent_bytes_total",
+		"Bytes of MQTT packets sent by type", "type")
+	connects = metrics.Default.NewCounterVec("lwmq_connects_total",
+		"CONNECT requests by result", "result")
+	disconnects = metrics.Default.NewCounterVec("lwmq_disconnects_total",
+		"Client disconnects by reason", "reason")
+	retries = metrics.Default.NewCounter("lwmq_publish_retries_total",
+		"PUBLISH and PUBREL resent to clients not acknowledged")
+	drops = metrics.Default.NewCounterVec("lwmq_messages_dropped_total",
+		"Messages dropped by reason", "reason")
+)
+
+// Results of CONNECT
+const (
+	connectAccepted       = "accepted"
+	connectBadCredentials = "bad_credentials"
+	connectNotAuthorized  = "not_authorized"
+	connectRejected       = "rejected" // Client ID in use
+	connectInvalid        = "invalid"  // Protocol error
+)
+
+// Reasons of disconnect
+const (
+	disconnectNormal   = "disconnect" // DISCONNECT packet
+	disconnectTimeout  = "keepalive_timeout"
+	disconnectLost     = "connection_lost"
+	disconnectShutdown = "shutdown"
+)
+
+// Reasons of dropped message
+const (
+	dropNotAuthorized = "not_authorized"
+	dropQueueFull     = "queue_full"    // Offline session queue is full
+	dropExpired       = "expired"       // Not acknowledged after retries
+	dropNoPid         = "no_pid"        // Every pid of session waits ack
+	dropQueueExpired  = "queue_expired" // Queued for offline session longer than expiry
+)
+
+var packetNames = []string{
+	"RESERVED", "CONNECT", "CONNACK", "PUBLISH", "PUBACK", "PUBREC", "PUBREL", "PUBCOMP",
+	"SUBSCRIBE", "SUBACK", "UNSUBSCRIBE", "UNSUBACK", "PINGREQ", "PINGRESP", "DISCONNECT", "RESERVED",
+}
+
+// Name of packet type in first byte of packet
+func packetName(buff []byte) string {
+	if len(buff) == 0 {
+		return packetNames[Reserved]
+	}
+
+	return packetNames[buff[0]>>4]
+}
+
+// Count packet received
+func countIn(buff []byte, size uint32) {
+	name := packetName(buff)
+	packetsIn.With(name).Inc()
+	bytesIn.With(name).Add(uint64(size))
+}
+
+// Send packet to client and count it
+func sendPacket(cl iface.Iclient, buff []byte) {
+	name := packetName(buff)
+	packetsOut.With(name).Inc()
+	bytesOut.With(name).Add(uint64(len(buff)))
+
+	cl.Send(buff, uint32(len(buff)))
+}
+
+// Register gauges read from server
+func (s *MQTTserver) registerMetrics() {
+	metrics.Default.NewGaugeFunc("lwmq_clients_online", "Clients connected", func() float64 {
+		return float64(s.Stats().Online)
+	})
+	metrics.Default.NewGaugeFunc("lwmq_sessions", "Sessions of online and offline clients", func() float64 {
+		return float64(s.Stats().Sessions)
+	})
+	metrics.Default.NewGaugeFunc("lwmq_subscriptions", "Topic filters subscribed", func() float64 {
+		return float64(s.Stats().Subscriptions)
+	})
+	metrics.Default.NewGaugeFunc("lwmq_retained_messages", "Retained messages", func() float64 {
+		return float64(s.Stats().Retained)
+	})
+	metrics.Default.NewGaugeFunc("lwmq_inflight_messages",
+		"QoS 1 and 2 deliveries waiting for acknowledge, queued ones of offline sessions included", func() float64 {
+			return float64(s.Stats().Inflight)
+		})
+}
@@ -0,0 +1,237 @@
+package dispatcher
+
+import (
+	"container/list"
+	"lwmq/mlog"
+	"lwmq/store"
+	"sync"
+	"time"
+)
+
+// SetStore set persistence of sessions, retained and inflight messages,
+// nil keeps state in memory only
+func (s *MQTTserver) SetStore(st store.Store) {
+	s.store = st
+}
+
+// Save persistent session with subscriptions
+func (s *MQTTserver) saveSession(mc *MQTTClient) {
+	if (s.store == nil) || (mc == nil) || !mc.IsPersistent() {
+		return
+	}
+
+	session := &store.Session{
+		ClientID:    mc.ClientID,
+		Username:    mc.Username,
+		ConnectFlag: mc.ConnectFlag,
+		CreateTime:  mc.CreateTime,
+	}
+
+	mc.lock.Lock()
+	for j := mc.SubList.Front(); j != nil; j = j.Next() {
+		subscribe := j.Value.(*SubTopic)
+		session.Subscriptions = append(session.Subscriptions, &store.Subscription{
+			Topic: subscribe.Topic,
+			Qos:   subscribe.Qos,
+		})
+	}
+	mc.lock.Unlock()
+
+	if err := s.store.SaveSession(session); err != nil {
+		mlog.Error("Save session error:", err)
+	}
+}
+
+// Delete session and its inflight messages
+func (s *MQTTserver) deleteSession(mc *MQTTClient) {
+	if (s.store == nil) || !mc.IsPersistent() {
+		return
+	}
+
+	if err := s.store.DeleteSession(mc.ClientID); err != nil {
+		mlog.Error("Delete session error:", err)
+	}
+}
+
+// StoreRetain replace retained message of topic, empty payload deletes it
+func (s *MQTTserver) StoreRetain(pub *PubTopic) {
+	s.Retains.Store(pub)
+
+	if s.store == nil {
+		return
+	}
+
+	var err error
+	if len(pub.Payload) == 0 {
+		err = s.store.DeleteRetain(pub.Topic)
+	} else {
+		err = s.store.SaveRetain(&store.Message{
+			Topic:   pub.Topic,
+			Qos:     pub.Qos,
+			Payload: pub.Payload,
+		})
+	}
+
+	if err != nil {
+		mlog.Error("Save retained message error:", err)
+	}
+}
+
+// Save inflight message sent to persistent session
+func (s *MQTTserver) saveInflight(mc *MQTTClient, waitack *WaitAck, state byte) {
+	if (s.store == nil) || !mc.IsPersistent() {
+		return
+	}
+
+	pub := waitack.Pub
+	err := s.store.SaveInflight(&store.Inflight{
+		Seq:      waitack.seq,
+		Time:     waitack.created.Unix(),
+		ClientID: mc.ClientID,
+		Pid:      waitack.pids[mc],
+		State:    state,
+		Topic:    pub.Topic,
+		Qos:      pub.Qos,
+		Retain:   pub.Retain,
+		Payload:  pub.Payload,
+	})
+	if err != nil {
+		mlog.Error("Save inflight error:", err)
+	}
+}
+
+// Save Qos 2 pid received from persistent session
+func (s *MQTTserver) saveRecvPid(mc *MQTTClient, pid uint32) {
+	if (s.store == nil) || !mc.IsPersistent() {
+		return
+	}
+
+	err := s.store.SaveInflight(&store.Inflight{
+		ClientID: mc.ClientID,
+		Pid:      pid,
+		State:    store.Received,
+	})
+	if err != nil {
+		mlog.Error("Save inflight error:", err)
+	}
+}
+
+// Delete acknowledged inflight message
+func (s *MQTTserver) deleteInflight(mc *MQTTClient, pid uint32, state byte) {
+	if (s.store == nil) || (mc == nil) || !mc.IsPersistent() {
+		return
+	}
+
+	if err := s.store.DeleteInflight(mc.ClientID, pid, state); err != nil {
+		mlog.Error("Delete inflight error:", err)
+	}
+}
+
+// LoadStore restore sessions, retained and inflight messages from store,
+// must be called before accepting connections
+func (s *MQTTserver) LoadStore() error {
+	if s.store == nil {
+		return nil
+	}
+
+	state, err := s.store.Load()
+	if err != nil {
+		return err
+	}
+
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+
+	// Sessions are offline until client connects again
+	for _, session := range state.Sessions {
+		mc := &MQTTClient{
+			ClientID:    session.ClientID,
+			Username:    session.Username,
+			Status:      Disconnected,
+			ConnectFlag: session.ConnectFlag,
+			CreateTime:  session.CreateTime,
+			SubList:     list.New(),
+			RecvPids:    make(map[uint32]bool),
+			inflight:    make(map[uint32]*WaitAck),
+			lock:        new(sync.Mutex),
+		}
+
+		for _, sub := range session.Subscriptions {
+			mc.SubList.PushBack(&SubTopic{
+				Topic: sub.Topic,
+				Qos:   sub.Qos,
+			})
+			s.SubIndex.Subscribe(mc.ClientID, sub.Topic, sub.Qos)
+		}
+
+		s.Mclients[mc.ClientID] = mc
+		s.TotalClients++
+	}
+
+	for _, msg := range state.Retains {
+		s.Retains.Store(&PubTopic{
+			Topic:   msg.Topic,
+			Qos:     msg.Qos,
+			Payload: msg.Payload,
+		})
+	}
+
+	// Inflight messages with same seq are one publish to many sessions, pid
+	// is allocated by each session. Records without time expire from now
+	now := time.Now()
+	waitacks := make(map[uint64]*WaitAck)
+	for _, inflight := range state.Inflight {
+		mc, exist := s.Mclients[inflight.ClientID]
+		if !exist {
+			continue
+		}
+
+		if inflight.State == store.Received {
+			mc.RecvPids[inflight.Pid] = true
+			continue
+		}
+
+		waitack, exist := waitacks[inflight.Seq]
+		if !exist {
+			created := now
+			if inflight.Time > 0 {
+				created = time.Unix(inflight.Time, 0)
+			}
+
+			waitack = newWaitAck(&PubTopic{
+				Topic:   inflight.Topic,
+				Qos:     inflight.Qos,
+				Dup:     true,
+				Retain:  inflight.Retain,
+				Payload: inflight.Payload,
+			}, inflight.Seq, created)
+			waitacks[inflight.Seq] = waitack
+			waitack.elem = s.Publist.PushBack(waitack)
+		}
+		mc.inflight[inflight.Pid] = waitack
+		waitack.pids[mc] = inflight.Pid
+
+		switch inflight.State {
+		case store.WaitAck:
+			waitack.WaitAck.PushBack(mc)
+		case store.WaitRec:
+			waitack.WaitRec.PushBack(mc)
+		case store.WaitComp:
+			waitack.WaitComp.PushBack(mc)
+		}
+		mc.Queued++
+		mc.QueuedBytes += len(inflight.Payload)
+
+		if inflight.Pid > mc.nextPid {
+			mc.nextPid = inflight.Pid
+		}
+		if inflight.Seq > s.pubSeq {
+			s.pubSeq = inflight.Seq
+		}
+	}
+
+	mlog.Warning("Load store, sessions:", len(state.Sessions),
+		" retained:", len(state.Retains), " inflight:", len(state.Inflight))
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package dispatcher
+
+import (
+	"container/list"
+	"lwmq/store"
+	"time"
+)
+
+// QueueLimits limits of Qos 1 and 2 messages queued for offline persistent session
+type QueueLimits struct {
+	MaxMessages int           // Messages of one session
+	MaxBytes    int           // Payload bytes of one session, 0 is no limit
+	Expiry      time.Duration // Queued messages older than it are dropped, 0 keeps them
+}
+
+// SetQueueLimits set limits of offline queues, messages already queued are
+// kept until they expire
+func (s *MQTTserver) SetQueueLimits(limits QueueLimits) {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+
+	s.queueLimits = limits
+}
+
+// Check if offline session can queue one more message, lock must be held
+func (s *MQTTserver) canQueue(mc *MQTTClient, pub *PubTopic) bool {
+	if mc.Queued >= s.queueLimits.MaxMessages {
+		return false
+	}
+
+	if s.queueLimits.MaxBytes > 0 {
+		return (mc.QueuedBytes + len(pub.Payload)) <= s.queueLimits.MaxBytes
+	}
+
+	return true
+}
+
+// Check if wait ack is queued longer than expiry, lock must be held
+func (s *MQTTserver) queueExpired(waitack *WaitAck, now time.Time) bool {
+	return (s.queueLimits.Expiry > 0) && (now.Sub(waitack.created) > s.queueLimits.Expiry)
+}
+
+// Remove offline sessions from wait lists, lock must be held
+func (s *MQTTserver) expireQueued(waitack *WaitAck) {
+	size := len(waitack.Pub.Payload)
+
+	for _, w := range []struct {
+		l     *list.List
+		state byte
+	}{
+		{waitack.WaitAck, store.WaitAck},
+		{waitack.WaitRec, store.WaitRec},
+		{waitack.WaitComp, store.WaitComp},
+	} {
+		var next *list.Element
+		for j := w.l.Front(); j != nil; j = next {
+			next = j.Next()
+			v := j.Value.(*MQTTClient)
+			if v.Status == Connected {
+				continue
+			}
+
+			pid, _ := waitack.remove(w.l, v)
+			s.deleteInflight(v, pid, w.state)
+			drops.With(dropQueueExpired).Inc()
+
+			if v.Queued > 0 {
+				v.Queued--
+			}
+			if v.QueuedBytes -= size; v.QueuedBytes < 0 {
+				v.QueuedBytes = 0
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package dispatcher
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Connect persistent session, subscribe and lose connection, session is kept offline
+func offlineSession(t *testing.T, clientID string, filter string) *MQTTClient {
+	mc := connectSubscribe(t, clientID, true, filter, 1)
+
+	mc.ConnClient.Stop()
+	loseConnection(mc, mc.ConnClient)
+	Mserver.removeClient(mc)
+
+	if info, exist := Mserver.Client(clientID); !exist || info.Connected {
+		t.Fatalf("session %s is not kept offline", clientID)
+	}
+
+	return mc
+}
+
+func setQueueLimits(t *testing.T, limits QueueLimits) {
+	Mserver.SetQueueLimits(limits)
+	t.Cleanup(func() {
+		Mserver.SetQueueLimits(QueueLimits{MaxMessages: MaxQueued})
+	})
+}
+
+func TestOfflineQueueLimit(t *testing.T) {
+	const prefix = "queue-"
+	defer cleanSessions(t, prefix)
+
+	setQueueLimits(t, QueueLimits{MaxMessages: 5, MaxBytes: 40})
+
+	for _, c := range []struct {
+		name    string
+		payload string
+		queued  int
+	}{
+		{"messages", "1234", 5},          // 5 of 8 fit message limit
+		{"bytes", "1234567890abcdef", 2}, // 32 of 40 bytes fit, third is over
+		{"large", "1234567890abcdef" + "1234567890abcdef" + "1234567890", 0},
+	} {
+		clientID := prefix + c.name
+		filter := fmt.Sprintf("queue/%s/#", c.name)
+		offlineSession(t, clientID, filter)
+
+		for i := 0; i < 8; i++ {
+			Mserver.PubToClient(&PubTopic{
+				Topic:   fmt.Sprintf("queue/%s/%d", c.name, i),
+				Qos:     1,
+				Payload: []byte(c.payload),
+			})
+		}
+
+		info, _ := Mserver.Client(clientID)
+		if (info.Queued != c.queued) || (len(info.Inflight) != c.queued) {
+			t.Fatalf("%s: queued %d, in-flight %d, want %d", c.name, info.Queued, len(info.Inflight), c.queued)
+		}
+		if info.QueuedBytes != c.queued*len(c.payload) {
+			t.Fatalf("%s: queued bytes %d, want %d", c.name, info.QueuedBytes, c.queued*len(c.payload))
+		}
+	}
+}
+
+func TestOfflineQueueExpiry(t *testing.T) {
+	const prefix = "expiry-"
+	defer cleanSessions(t, prefix)
+
+	setQueueLimits(t, QueueLimits{MaxMessages: MaxQueued, Expiry: time.Hour})
+
+	offline := offlineSession(t, prefix+"offline", "expiry/#")
+	online := connectSubscribe(t, prefix+"online", false, "expiry/#", 1)
+
+	Mserver.PubToClient(&PubTopic{Topic: "expiry/a", Qos: 1, Payload: []byte("x")})
+
+	// Not expired yet
+	Mserver.Lock.Lock()
+	Mserver.checkPublist(time.Now().Add(time.Minute))
+	Mserver.Lock.Unlock()
+	if info, _ := Mserver.Client(offline.ClientID); len(info.Inflight) != 1 {
+		t.Fatalf("queued message expired early, in-flight %d", len(info.Inflight))
+	}
+
+	Mserver.Lock.Lock()
+	Mserver.checkPublist(time.Now().Add(2 * time.Hour))
+	Mserver.Lock.Unlock()
+
+	info, _ := Mserver.Client(offline.ClientID)
+	if (len(info.Inflight) != 0) || (info.Queued != 0) || (info.QueuedBytes != 0) {
+		t.Fatalf("offline queue not expired: in-flight %d queued %d bytes %d",
+			len(info.Inflight), info.Queued, info.QueuedBytes)
+	}
+
+	// Connected session waits for ack and retries
+	if info, _ := Mserver.Client(online.ClientID); len(info.Inflight) != 1 {
+		t.Fatalf("connected session lost in-flight message, in-flight %d", len(info.Inflight))
+	}
+
+	Mserver.PubAck(online.ConnClient, 1)
+	if stats := Mserver.Stats(); stats.Inflight != 0 {
+		t.Fatalf("in-flight %d after ack", stats.Inflight)
+	}
+}
@@ -2,10 +2,16 @@ package dispatcher
 
 import (
 	"container/list"
+	"context"
+	"lwmq/acl"
+	"lwmq/auth"
 	"lwmq/iface"
 	"lwmq/manager"
 	"lwmq/mlog"
+	"lwmq/mtopic"
+	"lwmq/store"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,31 +26,65 @@ type PubTopic struct {
 	Topic   string
 	Qos     byte
 	Pid     uint32
-	Payload []byte
+	Dup     bool
+	Retain  bool
+	Payload []byte // Application message
 }
 
 // MQTTClient client struct
 type MQTTClient struct {
+	msgsIn       uint64 // PUBLISH received, first for 64 bit atomic alignment
+	msgsOut      uint64 // PUBLISH sent
+	ClientID     string
+	Username     string
 	ConnClient   iface.Iclient
 	Status       uint32
 	ProtocolName string
 	ConnectFlag  byte
 	KeepAlive    uint32
-	LastTime     int64
+	LastTime     int64 // Unix time of last packet
 	CreateTime   string
 	SubList      *list.List
+	RecvPids     map[uint32]bool // Qos 2 pids received, wait PUBREL
+	WillFlag     bool
+	WillQos      byte
+	WillRetain   bool
+	WillTopic    string
+	WillMessage  []byte
+	Queued       int                 // Messages queued while session is offline
+	QueuedBytes  int                 // Payload bytes queued while session is offline
+	inflight     map[uint32]*WaitAck // Publish to client of each pid, wait ack, under lock of server
+	nextPid      uint32
 	lock         *sync.Mutex
 }
 
+// MaxQueued default max Qos 1 and 2 messages queued for offline session
+const MaxQueued = 1000
+
+// Max packet identifier, MQTT-2.3.1
+const maxPid = 0xffff
+
 // Refresh refresh last time
 func (s *MQTTClient) Refresh() {
-	if (s != nil) && (s.Status == Connected) && (s.KeepAlive > 0) {
-		s.LastTime = time.Now().Unix()
+	if s == nil {
+		return
 	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.LastTime = time.Now().Unix()
 }
 
-// CheckTmo check timeout
+// CheckTmo check timeout, keep alive 0 never times out
 func (s *MQTTClient) CheckTmo() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.KeepAlive == 0 {
+		return false
+	}
+
 	// MQTT-3.1.1
 	now := time.Now().Unix()
 
@@ -55,6 +95,65 @@ func (s *MQTTClient) CheckTmo() bool {
 	return false
 }
 
+// IsPersistent check if session is kept after disconnect, clean session = 0
+func (s *MQTTClient) IsPersistent() bool {
+	return (s.ConnectFlag & 0x02) == 0
+}
+
+// Resume bind persistent session to new connection
+func (s *MQTTClient) resume(mc *MQTTClient) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.ConnClient = mc.ConnClient
+	s.Username = mc.Username
+	s.ProtocolName = mc.ProtocolName
+	s.ConnectFlag = mc.ConnectFlag
+	s.KeepAlive = mc.KeepAlive
+	s.LastTime = mc.LastTime
+	s.WillFlag = mc.WillFlag
+	s.WillQos = mc.WillQos
+	s.WillRetain = mc.WillRetain
+	s.WillTopic = mc.WillTopic
+	s.WillMessage = mc.WillMessage
+	s.Queued = 0
+	s.QueuedBytes = 0
+	s.Status = Connected
+}
+
+// ClearWill discard will message
+func (s *MQTTClient) ClearWill() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.WillFlag = false
+	s.WillTopic = ""
+	s.WillMessage = nil
+}
+
+// TakeWill get will message and discard it, will is published only once
+func (s *MQTTClient) TakeWill() *PubTopic {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.WillFlag {
+		return nil
+	}
+
+	will := &PubTopic{
+		Topic:   s.WillTopic,
+		Qos:     s.WillQos,
+		Retain:  s.WillRetain,
+		Payload: s.WillMessage,
+	}
+
+	s.WillFlag = false
+	s.WillTopic = ""
+	s.WillMessage = nil
+
+	return will
+}
+
 // AddSubscribe add subscribe topic to client
 func (s *MQTTClient) AddSubscribe(sub *SubTopic) uint32 {
 	s.lock.Lock()
@@ -90,17 +189,17 @@ func (s *MQTTClient) DelSubscribe(topic string) uint32 {
 
 // HasSubscribe check if subscribe topic
 func (s *MQTTClient) HasSubscribe(topic string, qos byte) uint32 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	if s.Status != Connected {
 		return ConnErr
 	}
 
-	s.lock.Lock()
-	defer s.lock.Unlock()
-
 	// Search subscribe list to write data
 	for j := s.SubList.Front(); j != nil; j = j.Next() {
 		subscribe := j.Value.(*SubTopic)
-		if (subscribe.Topic == topic) && (subscribe.Qos >= qos) {
+		if (subscribe.Qos >= qos) && mtopic.Match(subscribe.Topic, topic) {
 			return Success
 		}
 	}
@@ -109,46 +208,164 @@ func (s *MQTTClient) HasSubscribe(topic string, qos byte) uint32 {
 }
 
 // PublishData publish data to subscribe topic
-func (s *MQTTClient) PublishData(pub *PubTopic, buff []byte, size uint32) uint32 {
+func (s *MQTTClient) PublishData(pub *PubTopic) uint32 {
+	s.lock.Lock()
 	if s.Status != Connected {
+		s.lock.Unlock()
 		return ConnErr
 	}
 
-	s.lock.Lock()
-	defer s.lock.Unlock()
-
-	// Search subscribe list to write data
+	// Search subscribe list, overlapping filters deliver once with max qos
+	matched := false
+	var subQos byte
 	for j := s.SubList.Front(); j != nil; j = j.Next() {
 		subscribe := j.Value.(*SubTopic)
-		// TODO: support wildcards
-		if subscribe.Topic == pub.Topic {
-			// set qos
-			buff[0] &= 0xf9
-			if pub.Qos > subscribe.Qos {
-				buff[0] |= (subscribe.Qos << 1)
-			} else {
-				buff[0] |= (pub.Qos << 1)
-			}
-
-			if s.ConnClient != nil {
-				s.ConnClient.Send(buff, size)
+		if mtopic.Match(subscribe.Topic, pub.Topic) {
+			if !matched || subscribe.Qos > subQos {
+				subQos = subscribe.Qos
 			}
-			break
+			matched = true
 		}
 	}
+	s.lock.Unlock()
+
+	if !matched {
+		return Success
+	}
+
+	return s.SendPublish(pub, subQos, pub.Pid)
+}
+
+// SendPublish send publish data with qos of subscription and pid of session
+func (s *MQTTClient) SendPublish(pub *PubTopic, subQos byte, pid uint32) uint32 {
+	qos := pub.Qos
+	if qos > subQos {
+		qos = subQos
+	}
+
+	buff := encodePUBLISH(pub, qos, pid)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.Status != Connected {
+		return ConnErr
+	}
+	atomic.AddUint64(&s.msgsOut, 1)
+
+	if s.ConnClient != nil {
+		sendPacket(s.ConnClient, buff)
+	}
 
 	return Success
 }
 
+// AddRecvPid record Qos 2 pid, return false if pid is already received
+func (s *MQTTClient) AddRecvPid(pid uint32) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.RecvPids[pid] {
+		return false
+	}
+
+	s.RecvPids[pid] = true
+	return true
+}
+
+// DelRecvPid release Qos 2 pid after PUBREL
+func (s *MQTTClient) DelRecvPid(pid uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.RecvPids, pid)
+}
+
+// Alloc pid of publish to client, pids are per session (MQTT-2.3.1-2), 0 if
+// every pid is waiting ack. Lock of server must be held
+func (s *MQTTClient) allocPid(waitack *WaitAck) uint32 {
+	if len(s.inflight) >= maxPid {
+		return 0
+	}
+
+	for i := 0; i < maxPid; i++ {
+		s.nextPid++
+		if s.nextPid > maxPid {
+			s.nextPid = 1
+		}
+
+		if _, exist := s.inflight[s.nextPid]; !exist {
+			s.inflight[s.nextPid] = waitack
+			waitack.pids[s] = s.nextPid
+			return s.nextPid
+		}
+	}
+
+	return 0
+}
+
 // WaitAck wait publish ack
 type WaitAck struct {
-	Pub      *PubTopic
+	Pub      *PubTopic // Pid is not used, each client has own pid
 	Dup      uint32
-	WaitAck  *list.List
-	waitRec  *list.List
-	WaitComp *list.List
+	WaitAck  *list.List             // Qos 1, wait PUBACK
+	WaitRec  *list.List             // Qos 2, wait PUBREC
+	WaitComp *list.List             // Qos 2, wait PUBCOMP
+	pids     map[*MQTTClient]uint32 // Pid allocated by each waiting client
+	elem     *list.Element          // Element of Publist, nil if not listed
+	seq      uint64                 // Publish order
+	created  time.Time              // Publish time, offline queues expire from it
 }
 
+func newWaitAck(pub *PubTopic, seq uint64, created time.Time) *WaitAck {
+	return &WaitAck{
+		Pub:      pub,
+		Dup:      1,
+		WaitAck:  list.New(),
+		WaitRec:  list.New(),
+		WaitComp: list.New(),
+		pids:     make(map[*MQTTClient]uint32),
+		seq:      seq,
+		created:  created,
+	}
+}
+
+// Check if any client still not acknowledged
+func (w *WaitAck) pending() bool {
+	return (w.WaitAck.Len() + w.WaitRec.Len() + w.WaitComp.Len()) > 0
+}
+
+// Remove client from wait list and release its pid, false if client is not
+// in list. Lock of server must be held
+func (w *WaitAck) remove(l *list.List, mc *MQTTClient) (uint32, bool) {
+	for j := l.Front(); j != nil; j = j.Next() {
+		if j.Value.(*MQTTClient) == mc {
+			l.Remove(j)
+			pid := w.pids[mc]
+			delete(w.pids, mc)
+			delete(mc.inflight, pid)
+			return pid, true
+		}
+	}
+
+	return 0, false
+}
+
+// Move client from one wait list to another, pid is kept
+func (w *WaitAck) move(from *list.List, to *list.List, mc *MQTTClient) bool {
+	for j := from.Front(); j != nil; j = j.Next() {
+		if j.Value.(*MQTTClient) == mc {
+			from.Remove(j)
+			to.PushBack(mc)
+			return true
+		}
+	}
+
+	return false
+}
+
+var logger = mlog.New("dispatcher")
+
 // MQTTserver server struct
 type MQTTserver struct {
 	TotalClients  uint32
@@ -156,10 +373,22 @@ type MQTTserver struct {
 	Lock          *sync.Mutex
 	Mclients      map[string]*MQTTClient
 	ConnMap       map[uint32]string
+	SubIndex      *SubTree
+	auth          auth.Authenticator
+	listenerAuth  map[string]auth.Authenticator // Authenticator of listener, overrides auth
+	acl           *acl.ACL
+	authLock      *sync.RWMutex // Lock of auth, listenerAuth and acl, they are reloaded live
+	Retains       *RetainStore
+	queueLimits   QueueLimits // Limits of offline queues, under Lock
+	pubSeq        uint64
+	store         store.Store
 	Publist       *list.List
-	PubEn         chan byte
-	wakelock      *sync.Mutex
-	cond          *sync.Cond
+	PubEn         chan byte // Wakeup publish work
+	workers       *sync.WaitGroup
+	watchers      map[chan *Event]bool // Channels of Watch
+	watchLock     *sync.Mutex
+	topics        *topicWatch // Recent topics and tails
+	sysInterval   int64       // Nanoseconds between $SYS publishes, 0 disables them
 }
 
 // Mserver global MQTT server
@@ -173,20 +402,28 @@ func (s *MQTTserver) AddMQTTClient(clientID string, mc *MQTTClient) uint32 {
 	mqttclient, exist := s.Mclients[clientID]
 	if exist {
 		if mqttclient.Status == Connected {
-			mqttclient.Status = Disconnected
+			s.setDisconnected(mqttclient)
 			return ConnExist
 		}
 
-		if (mc.ConnectFlag & 0x02) != 0 {
-			// Clean session
+		if !mc.IsPersistent() {
+			// Clean session, discard old session
+			s.unindexClient(mqttclient)
+			s.dropInflight(mqttclient)
+			s.deleteSession(mqttclient)
 			s.Mclients[clientID] = mc
 			s.ConnMap[mc.ConnClient.GetCid()] = clientID
 			s.OnlineClients++
+			s.emit(EventConnect, clientID, "", 0)
 			return Success
 		}
 
-		mqttclient.Status = Connected
+		// Resume session, keep subscriptions and queued messages
+		mqttclient.resume(mc)
+		s.ConnMap[mc.ConnClient.GetCid()] = clientID
 		s.OnlineClients++
+		s.saveSession(mqttclient)
+		s.emit(EventConnect, clientID, "", 0)
 		return ClientExist
 	}
 
@@ -194,12 +431,112 @@ func (s *MQTTserver) AddMQTTClient(clientID string, mc *MQTTClient) uint32 {
 	s.ConnMap[mc.ConnClient.GetCid()] = clientID
 	s.TotalClients++
 	s.OnlineClients++
+	s.saveSession(mc)
+	s.emit(EventConnect, clientID, "", 0)
 
 	mlog.Info("Add new client:", clientID)
 	return Success
 
 }
 
+// Mark client disconnected, online count is kept right if called more than once, lock must be held.
+// Status is written under lock of server and client, it is read under either
+func (s *MQTTserver) setDisconnected(mc *MQTTClient) {
+	if mc.Status == Connected {
+		s.OnlineClients--
+		s.emit(EventDisconnect, mc.ClientID, "", 0)
+	}
+
+	mc.lock.Lock()
+	mc.Status = Disconnected
+	mc.lock.Unlock()
+}
+
+// SetAuthenticator set authenticator of CONNECT, nil allows all clients
+func (s *MQTTserver) SetAuthenticator(a auth.Authenticator) {
+	s.authLock.Lock()
+	defer s.authLock.Unlock()
+
+	s.auth = a
+}
+
+// SetListenerAuth set authenticator of one listener, nil allows all clients of listener
+func (s *MQTTserver) SetListenerAuth(listener string, a auth.Authenticator) {
+	s.authLock.Lock()
+	defer s.authLock.Unlock()
+
+	s.listenerAuth[listener] = a
+}
+
+// ClearListenerAuth remove authenticator of one listener, it uses default authenticator again
+func (s *MQTTserver) ClearListenerAuth(listener string) {
+	s.authLock.Lock()
+	defer s.authLock.Unlock()
+
+	delete(s.listenerAuth, listener)
+}
+
+// Get authenticator of listener, default authenticator if listener has none
+func (s *MQTTserver) getAuth(listener string) auth.Authenticator {
+	s.authLock.RLock()
+	defer s.authLock.RUnlock()
+
+	if a, exist := s.listenerAuth[listener]; exist {
+		return a
+	}
+
+	return s.auth
+}
+
+// SetACL set topic access control list, nil allows all topics
+func (s *MQTTserver) SetACL(a *acl.ACL) {
+	s.authLock.Lock()
+	defer s.authLock.Unlock()
+
+	s.acl = a
+}
+
+// Get topic access control list
+func (s *MQTTserver) getACL() *acl.ACL {
+	s.authLock.RLock()
+	defer s.authLock.RUnlock()
+
+	return s.acl
+}
+
+// CanPublish check if client can publish to topic
+func (s *MQTTserver) CanPublish(mc *MQTTClient, topic string) bool {
+	// $SYS topics are published by broker only
+	if isSysTopic(topic) {
+		return false
+	}
+
+	a := s.getACL()
+	if a == nil {
+		return true
+	}
+
+	if mc == nil {
+		return false
+	}
+
+	return a.CanPublish(mc.ClientID, mc.Username, topic)
+}
+
+// CanSubscribe check if client can subscribe topic filter
+func (s *MQTTserver) CanSubscribe(mc *MQTTClient, filter string) bool {
+	a := s.getACL()
+	if a == nil {
+		return true
+	}
+
+	if mc == nil {
+		return false
+	}
+
+	return a.CanSubscribe(mc.ClientID, mc.Username, filter)
+}
+
 // GetMQTTClientIDbyCid search client from server
 func (s *MQTTserver) GetMQTTClientIDbyCid(cid uint32) string {
 	s.Lock.Lock()
@@ -248,20 +585,62 @@ func (s *MQTTserver) DelMQTTClient(clientID string) uint32 {
 
 	mlog.Info("Del MQTT client:", clientID)
 
-	_, exist := s.Mclients[clientID]
+	mqttclient, exist := s.Mclients[clientID]
 	if !exist {
 		return Success
 	}
 
-	cid := s.Mclients[clientID].ConnClient.GetCid()
+	s.delSession(mqttclient)
+
+	return Success
+}
+
+// Delete session from server, lock must be held
+func (s *MQTTserver) delSession(mqttclient *MQTTClient) {
+	clientID := mqttclient.ClientID
 
+	s.unindexClient(mqttclient)
+	s.dropInflight(mqttclient)
+	s.deleteSession(mqttclient)
 	delete(s.Mclients, clientID)
-	delete(s.ConnMap, cid)
+	if mqttclient.ConnClient != nil {
+		cid := mqttclient.ConnClient.GetCid()
+		if s.ConnMap[cid] == clientID {
+			delete(s.ConnMap, cid)
+		}
+	}
 
 	s.TotalClients--
-	s.OnlineClients--
+	s.setDisconnected(mqttclient)
+	s.emit(EventRemove, clientID, "", 0)
+}
 
-	return Success
+// RemoveMQTTClient connection closed, delete clean session or offline persistent session
+func (s *MQTTserver) RemoveMQTTClient(clientID string) uint32 {
+	s.Lock.Lock()
+	mqttclient, exist := s.Mclients[clientID]
+	s.Lock.Unlock()
+
+	if !exist {
+		return Success
+	}
+
+	if mqttclient.IsPersistent() {
+		return s.OfflineMQTTClient(clientID)
+	}
+
+	return s.DelMQTTClient(clientID)
+}
+
+// Remove all subscriptions of client from index
+func (s *MQTTserver) unindexClient(mc *MQTTClient) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	for j := mc.SubList.Front(); j != nil; j = j.Next() {
+		subscribe := j.Value.(*SubTopic)
+		s.SubIndex.Unsubscribe(mc.ClientID, subscribe.Topic)
+	}
 }
 
 // OfflineMQTTClient offline client from server
@@ -276,32 +655,131 @@ func (s *MQTTserver) OfflineMQTTClient(clientID string) uint32 {
 		return Success
 	}
 
-	mqttclient.Status = Disconnected
-	s.OnlineClients--
+	s.offlineSession(mqttclient)
+
+	return Success
+}
+
+// Keep session offline without connection, lock must be held
+func (s *MQTTserver) offlineSession(mqttclient *MQTTClient) {
+	if mqttclient.ConnClient != nil {
+		cid := mqttclient.ConnClient.GetCid()
+		if s.ConnMap[cid] == mqttclient.ClientID {
+			delete(s.ConnMap, cid)
+		}
+	}
+
+	s.setDisconnected(mqttclient)
+}
+
+// Remove session of lost connection like RemoveMQTTClient, nothing is done if
+// client ID is taken by a new session or session is resumed since mc is got
+func (s *MQTTserver) removeClient(mc *MQTTClient) uint32 {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+
+	if (s.Mclients[mc.ClientID] != mc) || (mc.Status == Connected) {
+		return Success
+	}
+
+	if mc.IsPersistent() {
+		s.offlineSession(mc)
+	} else {
+		s.delSession(mc)
+	}
 
 	return Success
 }
 
-func (s *MQTTserver) checkClient() {
+// PubWill publish will message of client, connection lost without DISCONNECT
+func (s *MQTTserver) PubWill(mc *MQTTClient) uint32 {
+	will := mc.TakeWill()
+	if will == nil {
+		return Success
+	}
+
+	mlog.Debug("Publish will of:", mc.ClientID, " topic:", will.Topic)
+
+	if !s.CanPublish(mc, will.Topic) {
+		mlog.Warning("Will not authorized:", mc.ClientID, " topic:", will.Topic)
+		drops.With(dropNotAuthorized).Inc()
+		return Fail
+	}
+
+	if will.Retain {
+		s.StoreRetain(will)
+	}
+
+	return s.PubToClient(will)
+}
+
+// Check keep alive and lost connections until ctx is done
+func (s *MQTTserver) checkClient(ctx context.Context) {
+	defer s.workers.Done()
+
 	for {
-		for k, v := range s.Mclients {
-			client := v
+		for _, client := range s.connectedClients() {
+			k := client.ClientID
+			timeout := client.CheckTmo()
 
-			if (client.Status == Connected) &&
-				(client.CheckTmo() || client.ConnClient.GetStatus() == manager.Closed) {
-				client.Status = DISCONNECT
-				client.ConnClient.Stop()
+			// Client may be disconnected or resumed since it is copied
+			s.Lock.Lock()
+			conn := client.ConnClient
+			lost := (client.Status == Connected) && (timeout || (conn.GetStatus() >= manager.Closed))
+			if lost {
+				s.setDisconnected(client)
+			}
+			s.Lock.Unlock()
 
-				// delete client
-				s.DelMQTTClient(k)
+			if !lost {
+				continue
 			}
+
+			logger.Info("Client lost", "clientid", k, "cid", conn.GetCid(), "timeout", timeout)
+
+			if timeout {
+				disconnects.With(disconnectTimeout).Inc()
+			} else {
+				disconnects.With(disconnectLost).Inc()
+			}
+
+			conn.Stop()
+
+			// Keep alive timeout or connection lost
+			s.PubWill(client)
+
+			// delete client, persistent session is kept offline, unless client
+			// reconnected since it is checked
+			s.removeClient(client)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
 		}
+	}
+}
+
+// Connected clients, copied under lock to check without it
+func (s *MQTTserver) connectedClients() []*MQTTClient {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
 
-		time.Sleep(time.Second)
+	var online []*MQTTClient
+	for _, mc := range s.Mclients {
+		if mc.Status == Connected {
+			online = append(online, mc)
+		}
 	}
+
+	return online
 }
 
-func (s *MQTTserver) pubWork() {
+// Resend unacknowledged data until ctx is done
+func (s *MQTTserver) pubWork(ctx context.Context) {
+	defer s.workers.Done()
+
 	for {
 		for {
 			// Get one from publish list
@@ -311,117 +789,416 @@ func (s *MQTTserver) pubWork() {
 				break
 			}
 
-			for i := s.Publist.Front(); i != nil; i = i.Next() {
-				publishData := i
-				waitack := publishData.Value.(*WaitAck)
-
-				if waitack.Dup > 2 {
-					// Construct publish data
-					publishTopic := waitack.Pub
-					if publishTopic.Qos == 1 {
-						if (waitack.WaitAck.Len() == 0) || (waitack.Dup >= 10) {
-							s.Publist.Remove(publishData)
-							break
-						}
-
-						// Republish, set DUP
-						publishTopic.Payload[0] |= 0x08
-						for j := waitack.WaitAck.Front(); j != nil; j = j.Next() {
-							v := j.Value.(*MQTTClient)
-							v.PublishData(publishTopic, publishTopic.Payload, uint32(len(publishTopic.Payload)))
-						}
-					} else {
-						// QOS 2, TODO
-					}
-				}
-
-				waitack.Dup++
-			}
+			s.checkPublist(time.Now())
 			s.Lock.Unlock()
 
-			time.Sleep(time.Second)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
 		}
 
 		// If no request, go to sleep
-		s.cond.L.Lock()
-		s.cond.Wait()
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.PubEn:
+			mlog.Debug("pubWork wakeup")
+		}
+	}
+}
+
+// Resend or expire each unacknowledged publish once, lock must be held
+func (s *MQTTserver) checkPublist(now time.Time) {
+	var next *list.Element
+	for i := s.Publist.Front(); i != nil; i = next {
+		next = i.Next()
+		waitack := i.Value.(*WaitAck)
+
+		if waitack.Dup >= 10 {
+			// Give up connected clients, offline sessions wait for reconnect
+			s.expireWaitAck(waitack)
+		}
+
+		if s.queueExpired(waitack, now) {
+			// Offline sessions did not reconnect in time
+			s.expireQueued(waitack)
+		}
+
+		if !waitack.pending() {
+			s.doneWaitAck(waitack)
+			continue
+		}
+
+		if (waitack.Dup > 2) && (waitack.Dup < 10) {
+			s.republish(waitack)
+		}
 
-		mlog.Info("pubWork wakeup")
-		s.cond.L.Unlock()
+		waitack.Dup++
 	}
 }
 
-// PubAck publish data ACK
-func (s *MQTTserver) PubAck(cl iface.Iclient, pid uint32) uint32 {
+// Start start background work of server, keep alive check and resend,
+// they exit when ctx is done
+func (s *MQTTserver) Start(ctx context.Context) {
+	s.workers.Add(3)
+
+	go s.pubWork(ctx)
+	go s.checkClient(ctx)
+	go s.sysWork(ctx)
+}
+
+// Shutdown wait background work exit after its ctx is done, then disconnect
+// clients and close store. Will messages are not published, persistent
+// sessions and their inflight messages stay in store
+func (s *MQTTserver) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	online := s.connectedClients()
+	for _, mc := range online {
+		if mc.ConnClient != nil {
+			mc.ConnClient.Stop()
+		}
+		s.RemoveMQTTClient(mc.ClientID)
+		disconnects.With(disconnectShutdown).Inc()
+	}
+
+	mlog.Warning("Disconnect clients on shutdown:", len(online))
+
+	if s.store == nil {
+		return nil
+	}
+
+	return s.store.Close()
+}
+
+// Resend data to clients not acknowledged
+func (s *MQTTserver) republish(waitack *WaitAck) {
+	// Republish, set DUP
+	publishTopic := waitack.Pub
+	publishTopic.Dup = true
+
+	for j := waitack.WaitAck.Front(); j != nil; j = j.Next() {
+		v := j.Value.(*MQTTClient)
+		if v.SendPublish(publishTopic, 1, waitack.pids[v]) == Success {
+			retries.Inc()
+		}
+	}
+
+	for j := waitack.WaitRec.Front(); j != nil; j = j.Next() {
+		v := j.Value.(*MQTTClient)
+		if v.SendPublish(publishTopic, 2, waitack.pids[v]) == Success {
+			retries.Inc()
+		}
+	}
+
+	// PUBREC received, resend PUBREL
+	for j := waitack.WaitComp.Front(); j != nil; j = j.Next() {
+		v := j.Value.(*MQTTClient)
+		if (v.Status == Connected) && (v.ConnClient != nil) {
+			respPUBREL(v.ConnClient, waitack.pids[v])
+			retries.Inc()
+		}
+	}
+}
+
+// Remove connected clients from wait lists, lock must be held
+func (s *MQTTserver) expireWaitAck(waitack *WaitAck) {
+	for _, w := range []struct {
+		l     *list.List
+		state byte
+	}{
+		{waitack.WaitAck, store.WaitAck},
+		{waitack.WaitRec, store.WaitRec},
+		{waitack.WaitComp, store.WaitComp},
+	} {
+		var next *list.Element
+		for j := w.l.Front(); j != nil; j = next {
+			next = j.Next()
+			v := j.Value.(*MQTTClient)
+			if v.Status == Connected {
+				pid, _ := waitack.remove(w.l, v)
+				s.deleteInflight(v, pid, w.state)
+				drops.With(dropExpired).Inc()
+			}
+		}
+	}
+}
+
+// Remove wait ack from publish list if every client acknowledged, lock must be held
+func (s *MQTTserver) doneWaitAck(waitack *WaitAck) {
+	if !waitack.pending() && (waitack.elem != nil) {
+		s.Publist.Remove(waitack.elem)
+		waitack.elem = nil
+	}
+}
+
+// Remove session from all wait lists and release its pids, lock must be held
+func (s *MQTTserver) dropInflight(mc *MQTTClient) {
+	for _, waitack := range mc.inflight {
+		for _, l := range []*list.List{waitack.WaitAck, waitack.WaitRec, waitack.WaitComp} {
+			if _, removed := waitack.remove(l, mc); removed {
+				break
+			}
+		}
+
+		s.doneWaitAck(waitack)
+	}
+}
+
+// ResendInflight send queued and unacknowledged data to resumed session
+func (s *MQTTserver) ResendInflight(mc *MQTTClient) uint32 {
 	s.Lock.Lock()
 	defer s.Lock.Unlock()
 
+	wake := false
 	for i := s.Publist.Front(); i != nil; i = i.Next() {
 		waitack := i.Value.(*WaitAck)
+		publishTopic := waitack.Pub
+		resend := false
+
+		pid := waitack.pids[mc]
 
-		if waitack.Pub.Pid == pid {
-			for j := waitack.WaitAck.Front(); j != nil; j = j.Next() {
-				v := j.Value.(*MQTTClient)
-				if v.ConnClient.GetCid() == cl.GetCid() {
-					s.Publist.Remove(i)
-					break
-				}
+		for j := waitack.WaitAck.Front(); j != nil; j = j.Next() {
+			if j.Value.(*MQTTClient) == mc {
+				mc.SendPublish(publishTopic, 1, pid)
+				resend = true
 			}
-			break
 		}
+
+		for j := waitack.WaitRec.Front(); j != nil; j = j.Next() {
+			if j.Value.(*MQTTClient) == mc {
+				mc.SendPublish(publishTopic, 2, pid)
+				resend = true
+			}
+		}
+
+		for j := waitack.WaitComp.Front(); j != nil; j = j.Next() {
+			if j.Value.(*MQTTClient) == mc {
+				respPUBREL(mc.ConnClient, pid)
+				resend = true
+			}
+		}
+
+		if resend {
+			// Restart retry of resent data
+			waitack.Dup = 1
+			wake = true
+		}
+	}
+
+	if wake {
+		s.wakePubWork()
+	}
+
+	return Success
+}
+
+// Get session of connection and its wait ack of pid, lock must be held
+func (s *MQTTserver) getWaitAck(cl iface.Iclient, pid uint32) (*MQTTClient, *WaitAck) {
+	clientID, exist := s.ConnMap[cl.GetCid()]
+	if !exist {
+		return nil, nil
+	}
+
+	mc, exist := s.Mclients[clientID]
+	if !exist {
+		return nil, nil
+	}
+
+	return mc, mc.inflight[pid]
+}
+
+// PubAck publish data ACK
+func (s *MQTTserver) PubAck(cl iface.Iclient, pid uint32) uint32 {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+
+	mc, waitack := s.getWaitAck(cl, pid)
+	if waitack == nil {
+		return Fail
+	}
+
+	if _, removed := waitack.remove(waitack.WaitAck, mc); !removed {
+		return Fail
 	}
+	s.deleteInflight(mc, pid, store.WaitAck)
+	s.doneWaitAck(waitack)
+
+	return Success
+}
+
+// PubRec publish data received, wait PUBCOMP
+func (s *MQTTserver) PubRec(cl iface.Iclient, pid uint32) uint32 {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+
+	mc, waitack := s.getWaitAck(cl, pid)
+	if waitack == nil {
+		return Fail
+	}
+
+	if waitack.move(waitack.WaitRec, waitack.WaitComp, mc) {
+		s.saveInflight(mc, waitack, store.WaitComp)
+	}
+
+	return Success
+}
+
+// PubComp publish data complete
+func (s *MQTTserver) PubComp(cl iface.Iclient, pid uint32) uint32 {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+
+	mc, waitack := s.getWaitAck(cl, pid)
+	if waitack == nil {
+		return Fail
+	}
+
+	if _, removed := waitack.remove(waitack.WaitComp, mc); !removed {
+		return Fail
+	}
+	s.deleteInflight(mc, pid, store.WaitComp)
+	s.doneWaitAck(waitack)
 
 	return Success
 }
 
 // PubToClient publish data to client
 func (s *MQTTserver) PubToClient(pub *PubTopic) uint32 {
-	if pub.Qos == 1 {
-		doPublish := false
-		// Qos 1 need to wait PUBACK, if not, republish the topic
-		s.Lock.Lock()
-		waitack := &WaitAck{
-			Pub:     pub,
-			Dup:     0,
-			WaitAck: list.New(),
+	s.topics.published(pub)
+
+	// Look up subscribers from index
+	matches := s.SubIndex.Match(pub.Topic)
+	if len(matches) == 0 {
+		return Success
+	}
+
+	s.Lock.Lock()
+	subscribers := make(map[*MQTTClient]byte, len(matches))
+	for clientID, subQos := range matches {
+		v, exist := s.Mclients[clientID]
+		if exist {
+			subscribers[v] = subQos
 		}
+	}
+	s.Lock.Unlock()
+
+	// Retain flag is not set when deliver to existing subscriptions
+	return s.deliver(pub, false, subscribers)
+}
+
+// PubRetained send retained messages matching topic filter to new subscriber
+func (s *MQTTserver) PubRetained(mc *MQTTClient, filter string, subQos byte) uint32 {
+	for _, pub := range s.Retains.Match(filter) {
+		s.deliver(pub, true, map[*MQTTClient]byte{mc: subQos})
+	}
+
+	return Success
+}
+
+// Deliver data to subscribers, each with pid of its session
+func (s *MQTTserver) deliver(pub *PubTopic, retain bool, subscribers map[*MQTTClient]byte) uint32 {
+	publishTopic := &PubTopic{
+		Topic:   pub.Topic,
+		Qos:     pub.Qos,
+		Retain:  retain,
+		Payload: pub.Payload,
+	}
+
+	s.Lock.Lock()
+	s.pubSeq++
+
+	// Qos 1 need to wait PUBACK, Qos 2 need to wait PUBREC and PUBCOMP,
+	// if not, republish the topic
+	waitack := newWaitAck(publishTopic, s.pubSeq, time.Now())
+
+	// Pids of connected subscribers, sent after lock is released
+	sendPids := make(map[*MQTTClient]uint32, len(subscribers))
+
+	for v, subQos := range subscribers {
 		// Put waiting clients to list
-		for _, v := range s.Mclients {
-			if v.HasSubscribe(pub.Topic, pub.Qos) == Success {
-				waitack.WaitAck.PushBack(v)
-				if !doPublish {
-					doPublish = true
-				}
-			}
-		}
-		if doPublish {
-			s.Publist.PushBack(waitack)
+		qos := publishTopic.Qos
+		if qos > subQos {
+			qos = subQos
 		}
-		s.Lock.Unlock()
 
-		for _, v := range s.Mclients {
-			v.PublishData(pub, pub.Payload, uint32(len(pub.Payload)))
+		if v.Status != Connected {
+			delete(subscribers, v)
+
+			// Queue Qos 1 and 2 data for offline session, sent when resumed
+			if (qos == 0) || !v.IsPersistent() {
+				continue
+			}
+
+			if !s.canQueue(v, publishTopic) {
+				logger.Warning("Offline queue full, drop", "clientid", v.ClientID, "queued", v.Queued,
+					"bytes", v.QueuedBytes, "topic", publishTopic.Topic)
+				drops.With(dropQueueFull).Inc()
+				continue
+			}
 		}
 
-		if doPublish {
-			waitack.Dup = 1
+		if qos == 0 {
+			continue
+		}
 
-			s.wakePubWork()
+		pid := v.allocPid(waitack)
+		if pid == 0 {
+			logger.Warning("No free pid, drop", "clientid", v.ClientID, "topic", publishTopic.Topic)
+			drops.With(dropNoPid).Inc()
+			delete(subscribers, v)
+			continue
 		}
-	} else if pub.Qos == 2 {
-		// TODO
-	} else {
-		// Qos 0
-		for _, v := range s.Mclients {
-			v.PublishData(pub, pub.Payload, uint32(len(pub.Payload)))
+		if v.Status != Connected {
+			v.Queued++
+			v.QueuedBytes += len(publishTopic.Payload)
+		} else {
+			sendPids[v] = pid
+		}
+
+		if qos == 1 {
+			waitack.WaitAck.PushBack(v)
+			s.saveInflight(v, waitack, store.WaitAck)
+		} else {
+			waitack.WaitRec.PushBack(v)
+			s.saveInflight(v, waitack, store.WaitRec)
 		}
 	}
 
+	doPublish := waitack.pending()
+	if doPublish {
+		waitack.elem = s.Publist.PushBack(waitack)
+	}
+	s.Lock.Unlock()
+
+	for v, subQos := range subscribers {
+		v.SendPublish(publishTopic, subQos, sendPids[v])
+	}
+
+	if doPublish {
+		s.wakePubWork()
+	}
+
 	return Success
 }
 
 func (s *MQTTserver) wakePubWork() {
-	s.cond.Signal()
+	select {
+	case s.PubEn <- 0x01:
+	default:
+	}
 }
 
 // OnAddClient client add callback
@@ -440,6 +1217,9 @@ var dispatchHandlers = map[byte]dispatchHandler{
 	PINGREQ:     HandlePINGREQ,
 	PUBLISH:     HandlePUBLISH,
 	PUBACK:      HandlePUBACK,
+	PUBREC:      HandlePUBREC,
+	PUBREL:      HandlePUBREL,
+	PUBCOMP:     HandlePUBCOMP,
 }
 
 // MIN return min(a, b)
@@ -530,7 +1310,7 @@ func checkMQTTdata(cl iface.Iclient, size uint32) uint32 {
 		buff[i] = cl.PickBuff(i)
 	}
 
-	mlog.Info("Check MQTT data:", buff, " size:", size)
+	mlog.Debug("Check MQTT data, size:", size)
 
 	command := buff[0] >> 4
 	_, exist := dispatchHandlers[command]
@@ -566,7 +1346,9 @@ func checkMQTTdata(cl iface.Iclient, size uint32) uint32 {
 
 // Dispatch data to every command handler
 func dispathMQTTdata(cl iface.Iclient, cid uint32, buff []byte, size uint32) uint32 {
-	mlog.Info("Dispatch MQTT data")
+	mlog.Debug("Dispatch MQTT data")
+
+	countIn(buff, size)
 
 	var status uint32
 	command := buff[0] >> 4
@@ -601,7 +1383,7 @@ func dispathMQTTdata(cl iface.Iclient, cid uint32, buff []byte, size uint32) uin
 
 		clientID := Mserver.GetMQTTClientIDbyCid(cid)
 		if len(clientID) > 0 {
-			Mserver.OfflineMQTTClient(clientID)
+			Mserver.RemoveMQTTClient(clientID)
 		}
 	}
 
@@ -615,12 +1397,17 @@ func init() {
 		Lock:          new(sync.Mutex),
 		Mclients:      make(map[string]*MQTTClient),
 		ConnMap:       make(map[uint32]string),
+		listenerAuth:  make(map[string]auth.Authenticator),
+		authLock:      new(sync.RWMutex),
+		SubIndex:      NewSubTree(),
+		Retains:       NewRetainStore(),
+		queueLimits:   QueueLimits{MaxMessages: MaxQueued},
 		Publist:       list.New(),
-		PubEn:         make(chan byte),
-		wakelock:      new(sync.Mutex),
+		PubEn:         make(chan byte, 1),
+		workers:       new(sync.WaitGroup),
+		watchers:      make(map[chan *Event]bool),
+		watchLock:     new(sync.Mutex),
+		topics:        newTopicWatch(),
 	}
-	Mserver.cond = sync.NewCond(Mserver.wakelock)
-
-	go Mserver.pubWork()
-	go Mserver.checkClient()
+	Mserver.registerMetrics()
 }
@@ -0,0 +1,61 @@
+package dispatcher
+
+import (
+	"lwmq/mtopic"
+	"sync"
+)
+
+// RetainStore retained messages, keyed by topic
+type RetainStore struct {
+	msgs map[string]*PubTopic
+	lock *sync.RWMutex
+}
+
+// NewRetainStore create retained message store
+func NewRetainStore() *RetainStore {
+	return &RetainStore{
+		msgs: make(map[string]*PubTopic),
+		lock: new(sync.RWMutex),
+	}
+}
+
+// Store replace retained message of topic, empty payload deletes it
+func (r *RetainStore) Store(pub *PubTopic) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if len(pub.Payload) == 0 {
+		delete(r.msgs, pub.Topic)
+		return
+	}
+
+	r.msgs[pub.Topic] = &PubTopic{
+		Topic:   pub.Topic,
+		Qos:     pub.Qos,
+		Retain:  true,
+		Payload: pub.Payload,
+	}
+}
+
+// Match get retained messages matching topic filter
+func (r *RetainStore) Match(filter string) []*PubTopic {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	var result []*PubTopic
+	for topic, pub := range r.msgs {
+		if mtopic.Match(filter, topic) {
+			result = append(result, pub)
+		}
+	}
+
+	return result
+}
+
+// Count get retained message count
+func (r *RetainStore) Count() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return len(r.msgs)
+}
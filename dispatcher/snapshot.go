@@ -0,0 +1,160 @@
+package dispatcher
+
+import (
+	"container/list"
+	"sort"
+	"sync/atomic"
+)
+
+// Subscription topic filter of client
+type Subscription struct {
+	Topic string `json:"topic"`
+	Qos   byte   `json:"qos"`
+}
+
+// Inflight message delivered to client and waiting for acknowledge
+type Inflight struct {
+	Pid   uint32 `json:"pid"`
+	Topic string `json:"topic"`
+	Qos   byte   `json:"qos"`
+	Wait  string `json:"wait"` // puback, pubrec or pubcomp
+}
+
+// ClientInfo state of client session, copied under lock
+type ClientInfo struct {
+	ClientID      string          `json:"client_id"`
+	Username      string          `json:"username"`
+	Connected     bool            `json:"connected"`
+	Persistent    bool            `json:"persistent"`
+	Listener      string          `json:"listener,omitempty"`
+	Remote        string          `json:"remote,omitempty"`
+	KeepAlive     uint32          `json:"keep_alive"`
+	CreateTime    string          `json:"create_time"`
+	Queued        int             `json:"queued"`       // Messages queued while offline
+	QueuedBytes   int             `json:"queued_bytes"` // Payload bytes queued while offline
+	LastSeen      int64           `json:"last_seen"`    // Unix time of last packet
+	MessagesIn    uint64          `json:"messages_in"`
+	MessagesOut   uint64          `json:"messages_out"`
+	Subscriptions []*Subscription `json:"subscriptions"`
+	Inflight      []*Inflight     `json:"inflight,omitempty"`
+}
+
+// Copy state of client, lock must be held
+func (s *MQTTserver) clientInfo(mc *MQTTClient) *ClientInfo {
+	info := &ClientInfo{
+		ClientID:      mc.ClientID,
+		Username:      mc.Username,
+		Connected:     mc.Status == Connected,
+		Persistent:    mc.IsPersistent(),
+		KeepAlive:     mc.KeepAlive,
+		CreateTime:    mc.CreateTime,
+		Queued:        mc.Queued,
+		QueuedBytes:   mc.QueuedBytes,
+		MessagesIn:    atomic.LoadUint64(&mc.msgsIn),
+		MessagesOut:   atomic.LoadUint64(&mc.msgsOut),
+		Subscriptions: []*Subscription{},
+	}
+
+	if info.Connected && (mc.ConnClient != nil) {
+		if conn := mc.ConnClient.GetConn(); conn != nil {
+			info.Listener = conn.GetListener()
+			info.Remote = conn.GetRemote()
+		}
+	}
+
+	mc.lock.Lock()
+	info.LastSeen = mc.LastTime
+	for j := mc.SubList.Front(); j != nil; j = j.Next() {
+		subscribe := j.Value.(*SubTopic)
+		info.Subscriptions = append(info.Subscriptions, &Subscription{Topic: subscribe.Topic, Qos: subscribe.Qos})
+	}
+	mc.lock.Unlock()
+
+	return info
+}
+
+// Clients get state of all sessions sorted by client ID, without in-flight messages
+func (s *MQTTserver) Clients() []*ClientInfo {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+
+	infos := make([]*ClientInfo, 0, len(s.Mclients))
+	for _, mc := range s.Mclients {
+		infos = append(infos, s.clientInfo(mc))
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ClientID < infos[j].ClientID
+	})
+
+	return infos
+}
+
+// Client get state of session with its in-flight messages
+func (s *MQTTserver) Client(clientID string) (*ClientInfo, bool) {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+
+	mc, exist := s.Mclients[clientID]
+	if !exist {
+		return nil, false
+	}
+
+	info := s.clientInfo(mc)
+	for i := s.Publist.Front(); i != nil; i = i.Next() {
+		waitack := i.Value.(*WaitAck)
+
+		for _, w := range []struct {
+			l    *list.List
+			qos  byte
+			name string
+		}{
+			{waitack.WaitAck, 1, "puback"},
+			{waitack.WaitRec, 2, "pubrec"},
+			{waitack.WaitComp, 2, "pubcomp"},
+		} {
+			for j := w.l.Front(); j != nil; j = j.Next() {
+				if j.Value.(*MQTTClient) == mc {
+					info.Inflight = append(info.Inflight, &Inflight{
+						Pid:   waitack.pids[mc],
+						Topic: waitack.Pub.Topic,
+						Qos:   w.qos,
+						Wait:  w.name,
+					})
+					break
+				}
+			}
+		}
+	}
+
+	return info, true
+}
+
+// Stats counters of server, copied at one time
+type Stats struct {
+	Sessions      uint32 `json:"sessions"` // Online and offline
+	Online        uint32 `json:"online"`
+	Subscriptions int    `json:"subscriptions"`
+	Retained      int    `json:"retained"`
+	Inflight      int    `json:"inflight"` // Deliveries waiting for acknowledge, queued ones included
+}
+
+// Stats get counters of server
+func (s *MQTTserver) Stats() *Stats {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+
+	stats := &Stats{
+		Sessions:      s.TotalClients,
+		Online:        s.OnlineClients,
+		Subscriptions: s.SubIndex.Count(),
+		Retained:      s.Retains.Count(),
+	}
+
+	for i := s.Publist.Front(); i != nil; i = i.Next() {
+		waitack := i.Value.(*WaitAck)
+		stats.Inflight += waitack.WaitAck.Len() + waitack.WaitRec.Len() + waitack.WaitComp.Len()
+	}
+
+	return stats
+}
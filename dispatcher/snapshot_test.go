@@ -0,0 +1,256 @@
+package dispatcher
+
+import (
+	"fmt"
+	"lwmq/iface"
+	"lwmq/manager"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Cids of test connections, far from cids of listeners
+var testCid uint32 = 1 << 24
+
+// Connection of test client, packets sent are counted only
+type testConn struct {
+	cid    uint32
+	status uint32
+	sent   uint64
+}
+
+func newTestConn() *testConn {
+	return &testConn{cid: atomic.AddUint32(&testCid, 1), status: uint32(manager.Idle)}
+}
+
+func (c *testConn) GetCid() uint32                                       { return c.cid }
+func (c *testConn) GetStatus() byte                                      { return byte(atomic.LoadUint32(&c.status)) }
+func (c *testConn) SetStatus(sts byte)                                   { atomic.StoreUint32(&c.status, uint32(sts)) }
+func (c *testConn) GetConn() iface.Iconn                                 { return nil }
+func (c *testConn) PickBuff(uint32) byte                                 { return 0 }
+func (c *testConn) GetWaitDataSize() uint32                              { return 0 }
+func (c *testConn) SetWaitDataSize(uint32)                               {}
+func (c *testConn) Send(buff []byte, size uint32)                        { atomic.AddUint64(&c.sent, 1) }
+func (c *testConn) SetHandler(iface.CheckHandler, iface.DispatchHandler) {}
+func (c *testConn) DispathData(iface.Iclient, uint32, []byte, uint32) uint32 {
+	return Success
+}
+func (c *testConn) ClearBuff()     {}
+func (c *testConn) Start()         {}
+func (c *testConn) Stop()          { c.SetStatus(manager.Closed) }
+func (c *testConn) Dequeue()       {}
+func (c *testConn) IsInWork() bool { return false }
+func (c *testConn) SetInWork(bool) {}
+
+// Session of new connection like CONNECT builds it
+func newTestSession(clientID string, persistent bool) *MQTTClient {
+	mc := newTestClient(clientID)
+	mc.ConnClient = newTestConn()
+	mc.Status = Connected
+	mc.ProtocolName = "MQTT"
+	mc.KeepAlive = 60
+	mc.LastTime = time.Now().Unix()
+	mc.CreateTime = time.Now().Format(time.UnixDate)
+	if !persistent {
+		mc.ConnectFlag = 0x02
+	}
+
+	return mc
+}
+
+// Delete sessions of client ID prefix left by test
+func cleanSessions(t *testing.T, prefix string) {
+	for _, info := range Mserver.Clients() {
+		if strings.HasPrefix(info.ClientID, prefix) {
+			Mserver.DelMQTTClient(info.ClientID)
+		}
+	}
+
+	for _, info := range Mserver.Clients() {
+		if strings.HasPrefix(info.ClientID, prefix) {
+			t.Errorf("session %s is left", info.ClientID)
+		}
+	}
+}
+
+// Mark session disconnected like checkClient when conn is closed, session
+// taken over or resumed by another connection is not changed
+func loseConnection(mc *MQTTClient, conn iface.Iclient) {
+	Mserver.Lock.Lock()
+	defer Mserver.Lock.Unlock()
+
+	if (Mserver.Mclients[mc.ClientID] == mc) && (mc.ConnClient == conn) {
+		Mserver.setDisconnected(mc)
+	}
+}
+
+// Check online count of server equals connected sessions
+func checkOnline(t *testing.T) {
+	Mserver.Lock.Lock()
+	defer Mserver.Lock.Unlock()
+
+	var online uint32
+	for _, mc := range Mserver.Mclients {
+		if mc.Status == Connected {
+			online++
+		}
+	}
+
+	if online != Mserver.OnlineClients {
+		t.Errorf("online count %d, connected sessions %d", Mserver.OnlineClients, online)
+	}
+	if uint32(len(Mserver.Mclients)) != Mserver.TotalClients {
+		t.Errorf("session count %d, sessions %d", Mserver.TotalClients, len(Mserver.Mclients))
+	}
+}
+
+// Run with -race: sessions connect, subscribe, publish, unsubscribe and go
+// away while the snapshot API is read, client IDs are shared to take over
+// sessions of each other
+func TestSnapshotConcurrent(t *testing.T) {
+	const (
+		prefix    = "race-"
+		writers   = 16
+		readers   = 4
+		rounds    = 300
+		clientIDs = 8
+	)
+
+	defer cleanSessions(t, prefix)
+
+	stop := make(chan struct{})
+	readersDone := new(sync.WaitGroup)
+	for i := 0; i < readers; i++ {
+		readersDone.Add(1)
+		go func(i int) {
+			defer readersDone.Done()
+
+			events, stopWatch := Mserver.Watch()
+			defer stopWatch()
+
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				case <-events:
+				default:
+				}
+
+				for _, info := range Mserver.Clients() {
+					if !strings.HasPrefix(info.ClientID, prefix) {
+						continue
+					}
+					for _, sub := range info.Subscriptions {
+						if len(sub.Topic) == 0 {
+							t.Error("empty subscription of", info.ClientID)
+						}
+					}
+				}
+
+				if info, exist := Mserver.Client(fmt.Sprintf("%s%d", prefix, (i+n)%clientIDs)); exist && (info.ClientID == "") {
+					t.Error("client without ID")
+				}
+
+				Mserver.Stats()
+				Mserver.Topics()
+			}
+		}(i)
+	}
+
+	writersDone := new(sync.WaitGroup)
+	for w := 0; w < writers; w++ {
+		writersDone.Add(1)
+		go func(w int) {
+			defer writersDone.Done()
+
+			for r := 0; r < rounds; r++ {
+				clientID := fmt.Sprintf("%s%d", prefix, (w+r)%clientIDs)
+				mc := newTestSession(clientID, (r%3) == 0)
+				conn := mc.ConnClient
+
+				if Mserver.AddMQTTClient(clientID, mc) == ConnExist {
+					// Client ID is in use, old session is marked disconnected
+					continue
+				}
+
+				filter := fmt.Sprintf("race/%d/+", w)
+				Mserver.Subscribe(clientID, filter, byte(r%3))
+				Mserver.Subscribe(clientID, "race/#", 0)
+				Mserver.PubToClient(&PubTopic{
+					Topic:   fmt.Sprintf("race/%d/x", w),
+					Qos:     byte(r % 3),
+					Payload: []byte("data"),
+				})
+				Mserver.Unsubscribe(clientID, filter)
+
+				// Connection closed, like checkClient and lost connection of worker
+				conn.Stop()
+				if (r % 2) == 0 {
+					loseConnection(mc, conn)
+					Mserver.removeClient(mc)
+				} else {
+					Mserver.RemoveMQTTClient(clientID)
+				}
+			}
+		}(w)
+	}
+
+	writersDone.Wait()
+	close(stop)
+	readersDone.Wait()
+
+	checkOnline(t)
+}
+
+// Session of lost connection is kept if client reconnected before it is removed
+func TestRemoveClientReconnected(t *testing.T) {
+	const prefix = "reconnect-"
+	defer cleanSessions(t, prefix)
+
+	for _, persistent := range []bool{false, true} {
+		clientID := fmt.Sprintf("%s%v", prefix, persistent)
+
+		lost := newTestSession(clientID, persistent)
+		if sts := Mserver.AddMQTTClient(clientID, lost); sts != Success {
+			t.Fatalf("add %s: status %d", clientID, sts)
+		}
+
+		// checkClient found connection lost
+		lost.ConnClient.Stop()
+		loseConnection(lost, lost.ConnClient)
+
+		// Client reconnects before lost session is removed, persistent
+		// session is resumed, clean session is replaced
+		again := newTestSession(clientID, persistent)
+		Mserver.AddMQTTClient(clientID, again)
+
+		Mserver.removeClient(lost)
+
+		info, exist := Mserver.Client(clientID)
+		if !exist {
+			t.Fatalf("persistent %v: reconnected session is deleted", persistent)
+		}
+		if !info.Connected {
+			t.Fatalf("persistent %v: reconnected session is offline", persistent)
+		}
+		checkOnline(t)
+
+		// Lost connection of current session is removed
+		again.ConnClient.Stop()
+		current := Mserver.getSession(clientID)
+		loseConnection(current, again.ConnClient)
+		Mserver.removeClient(current)
+
+		info, exist = Mserver.Client(clientID)
+		if persistent {
+			if !exist || info.Connected {
+				t.Fatal("persistent session is not kept offline")
+			}
+		} else if exist {
+			t.Fatal("clean session is not deleted")
+		}
+		checkOnline(t)
+	}
+}
@@ -0,0 +1,151 @@
+package dispatcher
+
+import (
+	"lwmq/mtopic"
+	"strings"
+	"sync"
+)
+
+// subNode one level of the subscription tree
+type subNode struct {
+	children map[string]*subNode
+	clients  map[string]byte // client ID -> subscribe qos
+}
+
+func newSubNode() *subNode {
+	return &subNode{
+		children: make(map[string]*subNode),
+		clients:  make(map[string]byte),
+	}
+}
+
+func (n *subNode) isEmpty() bool {
+	return len(n.children) == 0 && len(n.clients) == 0
+}
+
+// SubTree topic tree index of all subscriptions, one node per topic level
+type SubTree struct {
+	root  *subNode
+	count int
+	lock  *sync.RWMutex
+}
+
+// NewSubTree create subscription tree
+func NewSubTree() *SubTree {
+	return &SubTree{
+		root: newSubNode(),
+		lock: new(sync.RWMutex),
+	}
+}
+
+// Subscribe add or replace subscription of client
+func (t *SubTree) Subscribe(clientID string, filter string, qos byte) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	node := t.root
+	for _, level := range strings.Split(filter, mtopic.Separator) {
+		child, exist := node.children[level]
+		if !exist {
+			child = newSubNode()
+			node.children[level] = child
+		}
+		node = child
+	}
+
+	if _, exist := node.clients[clientID]; !exist {
+		t.count++
+	}
+	node.clients[clientID] = qos
+}
+
+// Unsubscribe remove subscription of client, empty nodes are pruned
+func (t *SubTree) Unsubscribe(clientID string, filter string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	levels := strings.Split(filter, mtopic.Separator)
+	path := make([]*subNode, 0, len(levels)+1)
+
+	node := t.root
+	path = append(path, node)
+	for _, level := range levels {
+		child, exist := node.children[level]
+		if !exist {
+			return
+		}
+		node = child
+		path = append(path, node)
+	}
+
+	if _, exist := node.clients[clientID]; !exist {
+		return
+	}
+	delete(node.clients, clientID)
+	t.count--
+
+	// Prune from leaf to root
+	for i := len(levels); i > 0; i-- {
+		if !path[i].isEmpty() {
+			break
+		}
+		delete(path[i-1].children, levels[i-1])
+	}
+}
+
+// Match get all clients subscribed to topic name, with max qos of each client
+func (t *SubTree) Match(topic string) map[string]byte {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	result := make(map[string]byte)
+	levels := strings.Split(topic, mtopic.Separator)
+	// Topics start with '$' not match wildcards at first level
+	sysTopic := len(topic) > 0 && topic[0] == '$'
+
+	t.match(t.root, levels, 0, sysTopic, result)
+
+	return result
+}
+
+func (t *SubTree) match(node *subNode, levels []string, idx int, sysTopic bool, result map[string]byte) {
+	wildcard := !(sysTopic && idx == 0)
+
+	// '#' matches this level and all below, also the parent level
+	if wildcard {
+		if child, exist := node.children[mtopic.MultiLevel]; exist {
+			addMatched(child, result)
+		}
+	}
+
+	if idx == len(levels) {
+		addMatched(node, result)
+		return
+	}
+
+	if child, exist := node.children[levels[idx]]; exist {
+		t.match(child, levels, idx+1, sysTopic, result)
+	}
+
+	if wildcard {
+		if child, exist := node.children[mtopic.SingleLevel]; exist {
+			t.match(child, levels, idx+1, sysTopic, result)
+		}
+	}
+}
+
+func addMatched(node *subNode, result map[string]byte) {
+	for clientID, qos := range node.clients {
+		if old, exist := result[clientID]; !exist || qos > old {
+			result[clientID] = qos
+		}
+	}
+}
+
+// Count get subscription count
+func (t *SubTree) Count() int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.count
+}
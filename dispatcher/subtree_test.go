@@ -0,0 +1,170 @@
+package dispatcher
+
+import (
+	"container/list"
+	"fmt"
+	"lwmq/mtopic"
+	"sync"
+	"testing"
+)
+
+// Client and subscription counts of benchmarks
+var benchSizes = []struct {
+	clients int
+	subs    int
+}{
+	{100, 10},
+	{1000, 10},
+	{10000, 10},
+	{1000, 100},
+}
+
+// Subscription j of client c, exact filters mixed with wildcards, the "+"
+// filters at second level are shared by all clients
+func benchFilter(c int, j int) string {
+	switch j % 4 {
+	case 0:
+		return fmt.Sprintf("home/%d/%d/temp", c, j)
+	case 1:
+		return fmt.Sprintf("home/+/%d/temp", j)
+	case 2:
+		return fmt.Sprintf("home/%d/%d/#", c, j)
+	}
+
+	return fmt.Sprintf("+/%d/%d/temp", c, j)
+}
+
+// Topics published in benchmarks, some match many filters and some none
+func benchTopics(clients int, subs int) []string {
+	var topics []string
+	for i := 0; i < 64; i++ {
+		c := (i * 7919) % clients
+		j := i % subs
+		topics = append(topics,
+			fmt.Sprintf("home/%d/%d/temp", c, j),
+			fmt.Sprintf("home/%d/%d/humidity", c, j),
+			fmt.Sprintf("office/%d/%d/temp", c, j),
+			fmt.Sprintf("garage/%d", c))
+	}
+
+	return topics
+}
+
+// Linear scan of every subscription list, how publish was matched before SubTree
+func subListMatch(clients []*MQTTClient, topic string) map[string]byte {
+	result := make(map[string]byte)
+	for _, mc := range clients {
+		mc.lock.Lock()
+		for j := mc.SubList.Front(); j != nil; j = j.Next() {
+			subscribe := j.Value.(*SubTopic)
+			if !mtopic.Match(subscribe.Topic, topic) {
+				continue
+			}
+			if old, exist := result[mc.ClientID]; !exist || subscribe.Qos > old {
+				result[mc.ClientID] = subscribe.Qos
+			}
+		}
+		mc.lock.Unlock()
+	}
+
+	return result
+}
+
+func newBenchClients(clients int, subs int) ([]*MQTTClient, *SubTree) {
+	tree := NewSubTree()
+	sessions := make([]*MQTTClient, 0, clients)
+
+	for c := 0; c < clients; c++ {
+		mc := newTestClient(fmt.Sprintf("client-%d", c))
+		for j := 0; j < subs; j++ {
+			filter := benchFilter(c, j)
+			qos := byte(j % 3)
+			mc.SubList.PushBack(&SubTopic{Topic: filter, Qos: qos})
+			tree.Subscribe(mc.ClientID, filter, qos)
+		}
+		sessions = append(sessions, mc)
+	}
+
+	return sessions, tree
+}
+
+func newTestClient(clientID string) *MQTTClient {
+	return &MQTTClient{
+		ClientID: clientID,
+		SubList:  list.New(),
+		RecvPids: make(map[uint32]bool),
+		inflight: make(map[uint32]*WaitAck),
+		lock:     new(sync.Mutex),
+	}
+}
+
+func TestSubTreeMatchesSubList(t *testing.T) {
+	clients, tree := newBenchClients(200, 12)
+
+	for _, topic := range benchTopics(200, 12) {
+		want := subListMatch(clients, topic)
+		got := tree.Match(topic)
+
+		if len(got) != len(want) {
+			t.Fatalf("topic %q: tree matched %d clients, list matched %d", topic, len(got), len(want))
+		}
+		for clientID, qos := range want {
+			if got[clientID] != qos {
+				t.Fatalf("topic %q client %s: tree qos %d, list qos %d", topic, clientID, got[clientID], qos)
+			}
+		}
+	}
+}
+
+func TestSubTreeUnsubscribe(t *testing.T) {
+	tree := NewSubTree()
+	tree.Subscribe("a", "x/+/z", 1)
+	tree.Subscribe("a", "x/#", 2)
+	tree.Subscribe("b", "x/y/z", 0)
+
+	if got := tree.Match("x/y/z"); (len(got) != 2) || (got["a"] != 2) || (got["b"] != 0) {
+		t.Fatalf("match before unsubscribe: %v", got)
+	}
+
+	tree.Unsubscribe("a", "x/#")
+	tree.Unsubscribe("b", "x/y/z")
+	tree.Unsubscribe("b", "not/subscribed")
+
+	if got := tree.Match("x/y/z"); (len(got) != 1) || (got["a"] != 1) {
+		t.Fatalf("match after unsubscribe: %v", got)
+	}
+	if tree.Count() != 1 {
+		t.Fatalf("count %d, want 1", tree.Count())
+	}
+
+	tree.Unsubscribe("a", "x/+/z")
+	if !tree.root.isEmpty() {
+		t.Fatal("empty nodes are not pruned")
+	}
+}
+
+func BenchmarkSubTreeMatch(b *testing.B) {
+	for _, size := range benchSizes {
+		_, tree := newBenchClients(size.clients, size.subs)
+		topics := benchTopics(size.clients, size.subs)
+
+		b.Run(fmt.Sprintf("clients=%d/subs=%d", size.clients, size.subs), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				tree.Match(topics[i%len(topics)])
+			}
+		})
+	}
+}
+
+func BenchmarkSubListMatch(b *testing.B) {
+	for _, size := range benchSizes {
+		clients, _ := newBenchClients(size.clients, size.subs)
+		topics := benchTopics(size.clients, size.subs)
+
+		b.Run(fmt.Sprintf("clients=%d/subs=%d", size.clients, size.subs), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				subListMatch(clients, topics[i%len(topics)])
+			}
+		})
+	}
+}
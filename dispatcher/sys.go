@@ -0,0 +1,130 @@
+package dispatcher
+
+import (
+	"context"
+	"fmt"
+	"lwmq/service"
+	"math"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Prefix of broker statistics topics
+const sysPrefix = "$SYS/broker/"
+
+// Windows of load averages, suffix of load topics
+var sysLoadWindows = []struct {
+	name   string
+	window time.Duration
+}{
+	{"1min", time.Minute},
+	{"5min", 5 * time.Minute},
+	{"15min", 15 * time.Minute},
+}
+
+// Check if topic is in $SYS tree, only broker publishes to it
+func isSysTopic(topic string) bool {
+	return (topic == "$SYS") || strings.HasPrefix(topic, "$SYS/")
+}
+
+// SetSysInterval set interval of $SYS topics, 0 disables them
+func (s *MQTTserver) SetSysInterval(interval time.Duration) {
+	atomic.StoreInt64(&s.sysInterval, int64(interval))
+}
+
+// Load averages per minute of one counter, like load of Unix
+type sysLoad struct {
+	topic string
+	read  func() uint64
+	last  uint64
+	avgs  []float64 // One per window of sysLoadWindows
+}
+
+// Add sample of counter after elapsed time
+func (l *sysLoad) update(elapsed time.Duration) {
+	value := l.read()
+	rate := float64(value-l.last) / elapsed.Minutes()
+	l.last = value
+
+	for i, w := range sysLoadWindows {
+		f := math.Exp(-elapsed.Seconds() / w.window.Seconds())
+		l.avgs[i] = l.avgs[i]*f + rate*(1-f)
+	}
+}
+
+// Publish retained message to $SYS topic, it is kept in memory only
+func (s *MQTTserver) publishSys(topic string, value string) {
+	pub := &PubTopic{
+		Topic:   sysPrefix + topic,
+		Retain:  true,
+		Payload: []byte(value),
+	}
+
+	s.Retains.Store(pub)
+	s.PubToClient(pub)
+}
+
+// Publish broker statistics to $SYS topics
+func (s *MQTTserver) publishStats(start time.Time, loads []*sysLoad) {
+	stats := s.Stats()
+
+	s.publishSys("version", "lwmq version "+service.Version)
+	s.publishSys("uptime", fmt.Sprintf("%d seconds", int64(time.Since(start).Seconds())))
+	s.publishSys("clients/connected", fmt.Sprint(stats.Online))
+	s.publishSys("clients/disconnected", fmt.Sprint(stats.Sessions-stats.Online))
+	s.publishSys("clients/total", fmt.Sprint(stats.Sessions))
+	s.publishSys("subscriptions/count", fmt.Sprint(stats.Subscriptions))
+	s.publishSys("retained messages/count", fmt.Sprint(stats.Retained))
+	s.publishSys("messages/received", fmt.Sprint(packetsIn.With(packetNames[PUBLISH]).Get()))
+	s.publishSys("messages/sent", fmt.Sprint(packetsOut.With(packetNames[PUBLISH]).Get()))
+	s.publishSys("bytes/received", fmt.Sprint(bytesIn.Sum()))
+	s.publishSys("bytes/sent", fmt.Sprint(bytesOut.Sum()))
+
+	for _, l := range loads {
+		for i, w := range sysLoadWindows {
+			s.publishSys("load/"+l.topic+"/"+w.name, fmt.Sprintf("%.2f", l.avgs[i]))
+		}
+	}
+}
+
+// Publish $SYS topics every interval until ctx is done
+func (s *MQTTserver) sysWork(ctx context.Context) {
+	defer s.workers.Done()
+
+	start := time.Now()
+	loads := []*sysLoad{
+		{topic: "messages/received", read: func() uint64 { return packetsIn.With(packetNames[PUBLISH]).Get() }},
+		{topic: "messages/sent", read: func() uint64 { return packetsOut.With(packetNames[PUBLISH]).Get() }},
+		{topic: "bytes/received", read: bytesIn.Sum},
+		{topic: "bytes/sent", read: bytesOut.Sum},
+		{topic: "connections", read: connects.With(connectAccepted).Get},
+	}
+	for _, l := range loads {
+		l.last = l.read()
+		l.avgs = make([]float64, len(sysLoadWindows))
+	}
+
+	// Interval is checked every second, it may change live
+	last := start
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+
+		interval := time.Duration(atomic.LoadInt64(&s.sysInterval))
+		if (interval <= 0) || (time.Since(last) < interval) {
+			continue
+		}
+
+		elapsed := time.Since(last)
+		last = time.Now()
+		for _, l := range loads {
+			l.update(elapsed)
+		}
+
+		s.publishStats(start, loads)
+	}
+}
@@ -0,0 +1,169 @@
+package dispatcher
+
+import (
+	"container/list"
+	"lwmq/mtopic"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Limits of recent topics, least recently published topic is dropped first
+const (
+	maxRecentTopics  = 10000
+	maxRecentPayload = 256 // Bytes of payload kept
+	tailQueueSize    = 256
+)
+
+// TopicInfo last message published to topic
+type TopicInfo struct {
+	Topic     string `json:"topic"`
+	Payload   []byte `json:"payload"` // Cut to maxRecentPayload
+	Qos       byte   `json:"qos"`
+	Retained  bool   `json:"retained"` // Retained message is kept for topic
+	Count     uint64 `json:"count"`    // Publishes seen since start
+	LastTime  int64  `json:"last_time"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// Message published, sent to tails
+type Message struct {
+	Topic   string
+	Payload []byte
+	Qos     byte
+	Retain  bool
+	Time    int64
+}
+
+// Recent topics in order of last publish, and tails of topic filters
+type topicWatch struct {
+	recent map[string]*list.Element // Value is *TopicInfo
+	order  *list.List
+	tails  map[chan *Message]string // Topic filter of tail
+	lock   *sync.Mutex
+}
+
+func newTopicWatch() *topicWatch {
+	return &topicWatch{
+		recent: make(map[string]*list.Element),
+		order:  list.New(),
+		tails:  make(map[chan *Message]string),
+		lock:   new(sync.Mutex),
+	}
+}
+
+// Record publish and send it to matching tails without blocking
+func (w *topicWatch) published(pub *PubTopic) {
+	now := time.Now().Unix()
+	payload := pub.Payload
+	truncated := len(payload) > maxRecentPayload
+	if truncated {
+		payload = payload[:maxRecentPayload]
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	var info *TopicInfo
+	if e, exist := w.recent[pub.Topic]; exist {
+		info = e.Value.(*TopicInfo)
+		w.order.MoveToBack(e)
+	} else {
+		info = &TopicInfo{Topic: pub.Topic}
+		w.recent[pub.Topic] = w.order.PushBack(info)
+
+		if w.order.Len() > maxRecentTopics {
+			oldest := w.order.Front()
+			w.order.Remove(oldest)
+			delete(w.recent, oldest.Value.(*TopicInfo).Topic)
+		}
+	}
+
+	info.Payload = append([]byte(nil), payload...)
+	info.Truncated = truncated
+	info.Qos = pub.Qos
+	info.Count++
+	info.LastTime = now
+
+	if len(w.tails) == 0 {
+		return
+	}
+
+	msg := &Message{
+		Topic:   pub.Topic,
+		Payload: pub.Payload,
+		Qos:     pub.Qos,
+		Retain:  pub.Retain,
+		Time:    now,
+	}
+	for ch, filter := range w.tails {
+		if !mtopic.Match(filter, pub.Topic) {
+			continue
+		}
+
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+// Topics get recent topics and topics with retained message, sorted by topic
+func (s *MQTTserver) Topics() []*TopicInfo {
+	topics := make(map[string]*TopicInfo)
+
+	s.topics.lock.Lock()
+	for topic, e := range s.topics.recent {
+		info := *e.Value.(*TopicInfo)
+		topics[topic] = &info
+	}
+	s.topics.lock.Unlock()
+
+	// "#" does not match $SYS topics
+	retained := append(s.Retains.Match(mtopic.MultiLevel), s.Retains.Match("$SYS/#")...)
+	for _, pub := range retained {
+		info, exist := topics[pub.Topic]
+		if !exist {
+			info = &TopicInfo{Topic: pub.Topic, Qos: pub.Qos, Payload: pub.Payload}
+			if len(info.Payload) > maxRecentPayload {
+				info.Payload = info.Payload[:maxRecentPayload]
+				info.Truncated = true
+			}
+			topics[pub.Topic] = info
+		}
+		info.Retained = true
+	}
+
+	result := make([]*TopicInfo, 0, len(topics))
+	for _, info := range topics {
+		result = append(result, info)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Topic < result[j].Topic
+	})
+
+	return result
+}
+
+// Tail get messages published to topics matching filter until stop is called,
+// messages are dropped if they are not read in time
+func (s *MQTTserver) Tail(filter string) (messages <-chan *Message, stop func(), ok bool) {
+	if !mtopic.ValidFilter(filter) {
+		return nil, nil, false
+	}
+
+	ch := make(chan *Message, tailQueueSize)
+
+	s.topics.lock.Lock()
+	s.topics.tails[ch] = filter
+	s.topics.lock.Unlock()
+
+	stop = func() {
+		s.topics.lock.Lock()
+		delete(s.topics.tails, ch)
+		s.topics.lock.Unlock()
+	}
+
+	return ch, stop, true
+}
@@ -6,4 +6,7 @@ type Iconn interface {
 	Write(buff []byte, size uint32)
 	Close()
 	FreeCid()
+	GetCertName() string // Client certificate name used as user name, empty if not used
+	GetListener() string // Name of service accepted the connection
+	GetRemote() string   // Remote address of client
 }
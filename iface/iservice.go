@@ -2,7 +2,7 @@ package iface
 
 // Iservicer lwmq service interface
 type Iservicer interface {
-	Start()
+	Start() error
 	Stop()
 	SetOnConnect(func(cid uint32, conn Iconn))
 	AllocCid() (uint32, byte)
@@ -128,6 +128,7 @@ type Client struct {
 	dispathData  func(iface.Iclient, uint32, []byte, uint32) uint32
 	requestCnt   uint32
 	workIndo     bool
+	log          *mlog.Logger
 }
 
 // ClientOnConn client on connect callback
@@ -146,6 +147,7 @@ func NewClient(cid uint32, conn iface.Iconn) iface.Iclient {
 		WaitDataSize: 0,
 		requestCnt:   0,
 		workIndo:     false,
+		log:          logger.With("cid", cid, "remote", conn.GetRemote()),
 	}
 }
 
@@ -212,7 +214,7 @@ func (c *Client) parseData(buffChan chan []byte) {
 				reqLen := c.WaitDataSize
 				getLen, reqBuff, isNew := c.ringbuff.GetData(reqLen)
 				if getLen != reqLen {
-					mlog.Error("Data size error!")
+					c.log.Error("Data size error", "want", reqLen, "got", getLen)
 					break
 				}
 
@@ -233,11 +235,14 @@ func (c *Client) parseData(buffChan chan []byte) {
 					data: reqeuestBuff,
 					size: uint32(len(reqeuestBuff)),
 				}
-				ClientManager.Queue(request)
+				if !ClientManager.Queue(request) {
+					// Dropped on shutdown
+					c.requestCnt--
+				}
 
 				c.Status = Idle
 			} else if c.Status == Err {
-				mlog.Error("Data format error!")
+				c.log.Error("Data format error")
 				c.ringbuff.Clear()
 				c.Status = Idle
 				break
@@ -248,18 +253,15 @@ func (c *Client) parseData(buffChan chan []byte) {
 
 		select {
 		case buff := <-buffChan:
-			mlog.Info("Get data:", len(buff))
 			c.ringbuff.PutData(buff)
-
-			//mlog.Info("Ring buff:", c.ringbuff.Buff)
 		}
 	}
 }
 
 // ReadHandler wait and read data
 func (c *Client) ReadHandler() {
-	mlog.Info("ReadHandler started")
-	defer mlog.Debug("ReadHandler exit:", c.Cid)
+	c.log.Debug("ReadHandler started")
+	defer c.log.Debug("ReadHandler exit")
 	defer c.Stop()
 
 	c.ringbuff.Size = 102400 * 2
@@ -283,11 +285,11 @@ func (c *Client) ReadHandler() {
 		// Read data from connection
 		rlen, err := c.Conn.Read(readBuf, sizeBuf)
 		if err != nil {
-			mlog.Error("Read exit!")
+			c.log.Debug("Read exit")
 			break
 		}
 
-		mlog.Info("read data:", readBuf[:rlen])
+		c.log.Debug("Read data", "size", rlen)
 
 		if rlen > 0 {
 			buffChan <- readBuf[:rlen]
@@ -303,22 +305,18 @@ func (c *Client) ReadHandler() {
 // Send handle write data
 func (c *Client) Send(data []byte, size uint32) {
 	if c.Status != Closed {
-		mlog.Info("Send data:", data)
+		c.log.Debug("Send data", "size", size)
 		c.WriteHandler(data, size)
 	}
 }
 
 // WriteHandler handle write data
 func (c *Client) WriteHandler(buff []byte, size uint32) {
-	mlog.Debug("WriteHandler started")
-
 	c.Conn.Write(buff, size)
 }
 
 // Dequeue start client
 func (c *Client) Dequeue() {
-	mlog.Debug("Dequeue")
-
 	c.requestCnt--
 }
 
@@ -334,7 +332,7 @@ func (c *Client) SetInWork(sts bool) {
 
 // Start start client
 func (c *Client) Start() {
-	mlog.Debug("Client start")
+	c.log.Debug("Client start")
 
 	ClientManager.AddClient(c.Cid, c)
 
@@ -344,7 +342,7 @@ func (c *Client) Start() {
 
 //Stop stop client
 func (c *Client) Stop() {
-	mlog.Debug("Client stop:", c.Cid)
+	c.log.Debug("Client stop")
 
 	if (c.Status != Closed) && (c.Status != Removed) {
 		c.Status = Closed
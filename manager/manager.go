@@ -2,11 +2,16 @@ package manager
 
 import (
 	"container/list"
+	"context"
 	"lwmq/iface"
 	"lwmq/mlog"
+	"runtime/debug"
 	"sync"
+	"time"
 )
 
+var logger = mlog.New("manager")
+
 // Manager clinet manager
 type Manager struct {
 	clients     map[uint32]iface.Iclient
@@ -16,6 +21,14 @@ type Manager struct {
 	cond        *sync.Cond
 	workinqueue bool // True: request of one client in sequence
 	onAddClient func(iface.Iclient)
+	busy        int  // Requests in work
+	draining    bool // New requests are dropped when set
+	stopped     bool // Workers exit when set
+	workers     *sync.WaitGroup
+	workerCnt   int           // Count of workers after resizing
+	workerIdx   int           // Index of next new worker
+	quitCnt     int           // Count of workers to exit when pool shrinks
+	busyTime    time.Duration // Total time of workers handling requests
 }
 
 // ClientManager manager
@@ -28,13 +41,13 @@ func (m *Manager) AddClient(cid uint32, clt iface.Iclient) {
 
 	_, exist := m.clients[cid]
 	if exist {
-		mlog.Error("Client exist error!")
+		logger.Error("Client exist", "cid", cid)
 		return
 	}
 
 	m.onAddClient(clt)
 	m.clients[cid] = clt
-	mlog.Debug("Add client:", cid)
+	logger.Debug("Add client", "cid", cid)
 }
 
 // RemoveClient remove client
@@ -44,12 +57,12 @@ func (m *Manager) RemoveClient(cid uint32) {
 
 	_, exist := m.clients[cid]
 	if !exist {
-		mlog.Error("Client not exist!")
+		logger.Error("Remove client not exist", "cid", cid)
 		return
 	}
 
 	delete(m.clients, cid)
-	mlog.Debug("Remove client:", cid)
+	logger.Debug("Remove client", "cid", cid)
 }
 
 // GetClient get client
@@ -72,15 +85,21 @@ func (m *Manager) wakeup() {
 	m.cond.Broadcast()
 }
 
-// Queue send request
-func (m *Manager) Queue(request iface.Irequest) {
+// Queue send request, false if it is dropped on shutdown
+func (m *Manager) Queue(request iface.Irequest) bool {
 	m.lock.Lock()
 	defer m.wakeup()
 	defer m.lock.Unlock()
 
+	if m.draining {
+		logger.Debug("Drop request on shutdown", "cid", request.GetCid(), "size", request.GetSize())
+		return false
+	}
+
 	m.works.PushBack(request)
 
-	mlog.Info("Queue:", request)
+	logger.Debug("Queue", "cid", request.GetCid(), "size", request.GetSize())
+	return true
 }
 
 // Retrieval a request from work pool
@@ -95,6 +114,7 @@ func (m *Manager) getOneWork() (iface.Irequest, bool) {
 	if !m.workinqueue {
 		Onerequest := m.works.Front()
 		m.works.Remove(Onerequest)
+		m.busy++
 
 		return Onerequest.Value.(iface.Irequest), true
 	}
@@ -106,11 +126,11 @@ func (m *Manager) getOneWork() (iface.Irequest, bool) {
 	cid := inReqeuest.GetCid()
 	cl, exist := m.clients[cid]
 	if !exist {
-		mlog.Warning("Client not exist, do request!")
+		logger.Warning("Client not exist, do request", "cid", cid)
 		request = inReqeuest
 	} else {
 		if cl.IsInWork() {
-			mlog.Info("Client in work, wait!")
+			logger.Debug("Client in work, wait", "cid", cid)
 		} else {
 			cl.SetInWork(true)
 			request = inReqeuest
@@ -122,66 +142,215 @@ func (m *Manager) getOneWork() (iface.Irequest, bool) {
 		return nil, false
 	}
 
+	m.busy++
 	return request, true
 }
 
+// Request finished by worker
+func (m *Manager) doneWork() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.busy--
+}
+
+// Check if worker should exit, all stop or pool shrinks
+func (m *Manager) shouldQuit() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.stopped {
+		return true
+	}
+
+	if m.quitCnt > 0 {
+		m.quitCnt--
+		return true
+	}
+
+	return false
+}
+
+// Check if no request is queued or in work
+func (m *Manager) isDrained() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return (m.works.Len() == 0) && (m.busy == 0)
+}
+
 // Single worker
 func (m *Manager) oneWorker(idx int) {
-	mlog.Debug("Worker:", idx, " started!")
+	logger.Debug("Worker started", "worker", idx)
 
-	defer func() {
-		if err := recover(); err != nil {
-			mlog.Debug("Worker:", idx, " exit:", err)
-		}
-	}()
+	defer m.workers.Done()
 
-	for {
+	for !m.shouldQuit() {
 		request, ok := m.getOneWork()
 		if ok {
-			mlog.Info("Worker:", idx, " Get data:", request.GetData())
-
-			if len(request.GetData()) == 0 {
-				mlog.Warning("Worker:", idx, " request has no data!")
-			}
-
-			cid := request.GetCid()
-			cl, exist := m.GetClient(cid)
-			if !exist {
-				mlog.Error("Client not exist, data may lost!")
-				continue
-			}
-
-			// start real work
-			cl.Dequeue()
-			status := cl.DispathData(cl, cid, request.GetData(), request.GetSize())
-			if m.workinqueue {
-				m.lock.Lock()
-				cl.SetInWork(false)
-				m.lock.Unlock()
-
-				m.wakeup()
-			}
-			if status != 0 {
-				mlog.Error("Process error! Close connection:", status)
-				cl.Stop()
-			}
-
+			m.doRequest(idx, request)
 		} else {
 			// If no request, go to sleep
 			m.cond.L.Lock()
 			m.cond.Wait()
 
-			mlog.Info("Worker:", idx, " wakeup")
+			logger.Debug("Worker wakeup", "worker", idx)
 
 			m.cond.L.Unlock()
 		}
 	}
 }
 
+// Handle one request got by getOneWork, panic of handler closes connection
+// of client and worker keeps running
+func (m *Manager) doRequest(idx int, request iface.Irequest) {
+	defer m.doneWork()
+
+	logger.Debug("Get request", "worker", idx, "cid", request.GetCid(), "size", request.GetSize())
+
+	if len(request.GetData()) == 0 {
+		logger.Warning("Request has no data", "worker", idx, "cid", request.GetCid())
+	}
+
+	cid := request.GetCid()
+	cl, exist := m.GetClient(cid)
+	if !exist {
+		logger.Error("Client not exist, data may lost", "cid", cid)
+		return
+	}
+
+	defer func() {
+		if m.workinqueue {
+			m.lock.Lock()
+			cl.SetInWork(false)
+			m.lock.Unlock()
+
+			m.wakeup()
+		}
+	}()
+
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Error("Panic in request, close connection", "worker", idx, "cid", cid,
+				"panic", err, "stack", string(debug.Stack()))
+			cl.Stop()
+		}
+	}()
+
+	// start real work
+	cl.Dequeue()
+	start := time.Now()
+	status := cl.DispathData(cl, cid, request.GetData(), request.GetSize())
+	m.addBusyTime(time.Since(start))
+
+	if status != 0 {
+		logger.Error("Process error, close connection", "cid", cid, "status", status)
+		cl.Stop()
+	}
+}
+
 // StartWorkers start work pool
 func (m *Manager) StartWorkers(workerCnt int) {
-	for i := 0; i < workerCnt; i++ {
-		go m.oneWorker(i)
+	m.SetWorkers(m.GetWorkers() + workerCnt)
+}
+
+// SetWorkers resize work pool, extra workers exit after their request in work
+func (m *Manager) SetWorkers(workerCnt int) {
+	m.lock.Lock()
+
+	if workerCnt < 0 {
+		workerCnt = 0
+	}
+
+	diff := workerCnt - m.workerCnt
+	m.workerCnt = workerCnt
+
+	if diff < 0 {
+		m.quitCnt -= diff
+		m.lock.Unlock()
+
+		m.wakeup()
+		logger.Debug("Workers shrink", "workers", workerCnt)
+		return
+	}
+
+	// Workers about to exit keep working
+	keep := diff
+	if keep > m.quitCnt {
+		keep = m.quitCnt
+	}
+	m.quitCnt -= keep
+
+	start := diff - keep
+	first := m.workerIdx
+	m.workerIdx += start
+	m.workers.Add(start)
+
+	m.lock.Unlock()
+
+	for i := 0; i < start; i++ {
+		go m.oneWorker(first + i)
+	}
+
+	logger.Debug("Workers grow", "workers", workerCnt)
+}
+
+// GetWorkers get count of workers
+func (m *Manager) GetWorkers() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.workerCnt
+}
+
+// Shutdown finish queued requests then stop workers, requests left are dropped if ctx is done.
+// Requests read after it is called are dropped, connections stay open to send responses
+// of queued ones, clients resend unacknowledged requests when they connect again
+func (m *Manager) Shutdown(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	m.lock.Lock()
+	m.draining = true
+	m.lock.Unlock()
+
+	// Drain work pool, wakeup workers in case one missed a request
+	var err error
+	for !m.isDrained() && (err == nil) {
+		m.wakeup()
+
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+
+			m.lock.Lock()
+			logger.Warning("Requests dropped on shutdown", "requests", m.works.Len())
+			m.lock.Unlock()
+		case <-ticker.C:
+		}
+	}
+
+	m.lock.Lock()
+	m.stopped = true
+	m.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.workers.Wait()
+		close(done)
+	}()
+
+	for {
+		m.wakeup()
+
+		select {
+		case <-done:
+			logger.Debug("Workers stopped")
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
 	}
 }
 
@@ -197,7 +366,9 @@ func init() {
 		lock:        new(sync.Mutex),
 		wakelock:    new(sync.Mutex),
 		workinqueue: false,
+		workers:     new(sync.WaitGroup),
 	}
 
 	ClientManager.cond = sync.NewCond(ClientManager.wakelock)
+	ClientManager.registerMetrics()
 }
@@ -0,0 +1,36 @@
+package manager
+
+import (
+	"lwmq/metrics"
+	"time"
+)
+
+// Add time of one request handled
+func (m *Manager) addBusyTime(d time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.busyTime += d
+}
+
+// Read value of manager with lock held
+func (m *Manager) read(f func() float64) func() float64 {
+	return func() float64 {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+
+		return f()
+	}
+}
+
+// Register gauges of work queue and workers
+func (m *Manager) registerMetrics() {
+	metrics.Default.NewGaugeFunc("lwmq_work_queue_depth", "Requests waiting for a worker",
+		m.read(func() float64 { return float64(m.works.Len()) }))
+	metrics.Default.NewGaugeFunc("lwmq_workers", "Workers in pool",
+		m.read(func() float64 { return float64(m.workerCnt) }))
+	metrics.Default.NewGaugeFunc("lwmq_workers_busy", "Workers handling a request",
+		m.read(func() float64 { return float64(m.busy) }))
+	metrics.Default.NewCounterFunc("lwmq_worker_busy_seconds_total", "Time of workers handling requests",
+		m.read(func() float64 { return m.busyTime.Seconds() }))
+}
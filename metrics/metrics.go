@@ -0,0 +1,218 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter value only goes up
+type Counter struct {
+	v uint64
+}
+
+// Inc add one
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+// Add add n
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+// Get get value
+func (c *Counter) Get() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+// CounterVec counters by value of one label
+type CounterVec struct {
+	counters map[string]*Counter
+	lock     *sync.RWMutex
+}
+
+// With get counter of label value, created if not exist
+func (v *CounterVec) With(label string) *Counter {
+	v.lock.RLock()
+	c, exist := v.counters[label]
+	v.lock.RUnlock()
+
+	if exist {
+		return c
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	c, exist = v.counters[label]
+	if !exist {
+		c = new(Counter)
+		v.counters[label] = c
+	}
+
+	return c
+}
+
+// Sum of counters of all labels
+func (v *CounterVec) Sum() uint64 {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+
+	var sum uint64
+	for _, c := range v.counters {
+		sum += c.Get()
+	}
+
+	return sum
+}
+
+// Values of all labels
+func (v *CounterVec) values() map[string]float64 {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+
+	values := make(map[string]float64, len(v.counters))
+	for label, c := range v.counters {
+		values[label] = float64(c.Get())
+	}
+
+	return values
+}
+
+// One metric family in registry
+type metric struct {
+	name   string
+	help   string
+	kind   string // counter or gauge
+	label  string // Name of label, empty if metric has one value
+	value  func() float64
+	values func() map[string]float64
+}
+
+// Registry metrics written in Prometheus text format
+type Registry struct {
+	metrics []*metric
+	names   map[string]bool
+	lock    *sync.Mutex
+}
+
+// Add metric, name must be unique
+func (r *Registry) add(m *metric) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.names[m.name] {
+		panic("metrics: duplicate metric " + m.name)
+	}
+
+	r.names[m.name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// NewCounter register counter
+func (r *Registry) NewCounter(name string, help string) *Counter {
+	c := new(Counter)
+	r.add(&metric{name: name, help: help, kind: "counter", value: func() float64 { return float64(c.Get()) }})
+
+	return c
+}
+
+// NewCounterVec register counters by value of label
+func (r *Registry) NewCounterVec(name string, help string, label string) *CounterVec {
+	v := &CounterVec{
+		counters: make(map[string]*Counter),
+		lock:     new(sync.RWMutex),
+	}
+	r.add(&metric{name: name, help: help, kind: "counter", label: label, values: v.values})
+
+	return v
+}
+
+// NewCounterFunc register counter read from f, f must not decrease
+func (r *Registry) NewCounterFunc(name string, help string, f func() float64) {
+	r.add(&metric{name: name, help: help, kind: "counter", value: f})
+}
+
+// NewGaugeFunc register gauge read from f
+func (r *Registry) NewGaugeFunc(name string, help string, f func() float64) {
+	r.add(&metric{name: name, help: help, kind: "gauge", value: f})
+}
+
+// NewGaugeVecFunc register gauges by value of label read from f
+func (r *Registry) NewGaugeVecFunc(name string, help string, label string, f func() map[string]float64) {
+	r.add(&metric{name: name, help: help, kind: "gauge", label: label, values: f})
+}
+
+// Format value, integers without exponent
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Escape label value, backslash, quote and newline
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WriteTo write all metrics in text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.lock.Lock()
+	metrics := make([]*metric, len(r.metrics))
+	copy(metrics, r.metrics)
+	r.lock.Unlock()
+
+	var b strings.Builder
+	for _, m := range metrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", m.name, m.kind)
+
+		if m.values == nil {
+			fmt.Fprintf(&b, "%s %s\n", m.name, formatValue(m.value()))
+			continue
+		}
+
+		values := m.values()
+		labels := make([]string, 0, len(values))
+		for label := range values {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+
+		for _, label := range labels {
+			fmt.Fprintf(&b, "%s{%s=\"%s\"} %s\n", m.name, m.label, labelEscaper.Replace(label), formatValue(values[label]))
+		}
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// ServeHTTP serve metrics, like GET /metrics
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// NewRegistry create empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		names: make(map[string]bool),
+		lock:  new(sync.Mutex),
+	}
+}
+
+// Default registry of broker
+var Default = NewRegistry()
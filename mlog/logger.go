@@ -0,0 +1,65 @@
+package mlog
+
+// Logger structured logger of a package, messages carry key/value fields:
+//
+//	log := mlog.New("manager").With("cid", cid, "remote", remote)
+//	log.Info("Client start", "size", size)
+type Logger struct {
+	pkg    string
+	fields []interface{}
+}
+
+// New create logger of package, level of package is set by SetLevel
+func New(pkg string) *Logger {
+	return &Logger{pkg: pkg}
+}
+
+// With create logger with more context fields, key and value in turn
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+
+	return &Logger{pkg: l.pkg, fields: fields}
+}
+
+// Write message of level with context fields and kv fields
+func (l *Logger) log(level byte, msg string, kv []interface{}) {
+	if !mlog.enabled(l.pkg, level) {
+		return
+	}
+
+	caller := ""
+	if level >= WARNING {
+		caller, _ = callerOf(2)
+	}
+
+	fields := l.fields
+	if len(kv) > 0 {
+		fields = make([]interface{}, 0, len(l.fields)+len(kv))
+		fields = append(fields, l.fields...)
+		fields = append(fields, kv...)
+	}
+
+	mlog.write(level, l.pkg, caller, msg, fields)
+}
+
+// Debug write debug message
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.log(DEBUG, msg, kv)
+}
+
+// Info write info message
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.log(INFO, msg, kv)
+}
+
+// Warning write warning message
+func (l *Logger) Warning(msg string, kv ...interface{}) {
+	l.log(WARNING, msg, kv)
+}
+
+// Error write error message
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.log(ERROR, msg, kv)
+}
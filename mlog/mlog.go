@@ -1,69 +1,305 @@
 package mlog
 
 import (
-	"log"
+	"encoding/json"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-// Debug level
+// Log level, message is written if its level is not less than min level
 const (
-	INFO = iota
-	DEBUG
+	DEBUG = iota
+	INFO
 	WARNING
 	ERROR
 )
 
-// Mlog my manual log
+// Output format
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Level names used by config
+var levelNames = map[string]byte{
+	"debug":   DEBUG,
+	"info":    INFO,
+	"warning": WARNING,
+	"error":   ERROR,
+}
+
+var levelTags = []string{"[D]", "[I]", "[W]", "[E]"}
+var levelJSON = []string{"debug", "info", "warning", "error"}
+
+// LevelByName get level of name: debug, info, warning or error
+func LevelByName(name string) (byte, bool) {
+	level, exist := levelNames[name]
+	return level, exist
+}
+
+// Mlog log settings and output shared by all loggers
 type Mlog struct {
-	logLevel byte
-	info     *log.Logger
-	debug    *log.Logger
-	warning  *log.Logger
-	err      *log.Logger
+	minLevel  byte
+	pkgLevels map[string]byte // Level of package, overrides min level
+	format    string
+	writer    io.Writer
+	lock      *sync.RWMutex
+	wlock     *sync.Mutex // Lock of writer
 }
 
 // Mlog My log
 var mlog *Mlog
 
-// SetMinLevel set min debug level
+// SetMinLevel set min level of packages without their own level
 func SetMinLevel(level byte) {
-	mlog.logLevel = level
+	mlog.lock.Lock()
+	defer mlog.lock.Unlock()
+
+	mlog.minLevel = level
+}
+
+// SetLevel set min level of one package, like "dispatcher"
+func SetLevel(pkg string, level byte) {
+	mlog.lock.Lock()
+	defer mlog.lock.Unlock()
+
+	mlog.pkgLevels[pkg] = level
+}
+
+// ClearLevels remove levels of all packages, min level is used
+func ClearLevels() {
+	mlog.lock.Lock()
+	defer mlog.lock.Unlock()
+
+	mlog.pkgLevels = make(map[string]byte)
+}
+
+// SetFormat set output format, text or json
+func SetFormat(format string) error {
+	if (format != FormatText) && (format != FormatJSON) {
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	mlog.lock.Lock()
+	defer mlog.lock.Unlock()
+
+	mlog.format = format
+	return nil
+}
+
+// SetOutput set writer of log, like os.Stdout or RotateFile
+func SetOutput(w io.Writer) {
+	mlog.wlock.Lock()
+	defer mlog.wlock.Unlock()
+
+	mlog.writer = w
+}
+
+// Check if message of package and level is written
+func (m *Mlog) enabled(pkg string, level byte) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if min, exist := m.pkgLevels[pkg]; exist {
+		return level >= min
+	}
+
+	return level >= m.minLevel
+}
+
+// Check if any message of level may be written, before looking up package
+func (m *Mlog) anyEnabled(level byte) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return (level >= m.minLevel) || (len(m.pkgLevels) > 0)
+}
+
+// Write one message with key/value fields
+func (m *Mlog) write(level byte, pkg string, caller string, msg string, kv []interface{}) {
+	m.lock.RLock()
+	format := m.format
+	m.lock.RUnlock()
+
+	var line []byte
+	if format == FormatJSON {
+		line = encodeJSON(level, pkg, caller, msg, kv)
+	} else {
+		line = encodeText(level, pkg, caller, msg, kv)
+	}
+
+	m.wlock.Lock()
+	defer m.wlock.Unlock()
+
+	m.writer.Write(line)
+}
+
+// Value of field, errors are written as their message
+func fieldValue(v interface{}) interface{} {
+	if err, ok := v.(error); ok {
+		return err.Error()
+	}
+
+	return v
+}
+
+// Walk key/value fields, missing value of last key is marked
+func eachField(kv []interface{}, do func(key string, value interface{})) {
+	for i := 0; i < len(kv); i += 2 {
+		key := fmt.Sprint(kv[i])
+		if i+1 >= len(kv) {
+			do("!BADKEY", key)
+			break
+		}
+
+		do(key, fieldValue(kv[i+1]))
+	}
+}
+
+// Text line: [W] 2006/01/02 15:04:05 [pkg] file.go:10: message key=value
+func encodeText(level byte, pkg string, caller string, msg string, kv []interface{}) []byte {
+	var b strings.Builder
+
+	b.WriteString(levelTags[level])
+	b.WriteString(time.Now().Format(" 2006/01/02 15:04:05 "))
+	if len(pkg) > 0 {
+		b.WriteString("[" + pkg + "] ")
+	}
+	if len(caller) > 0 {
+		b.WriteString(caller + ": ")
+	}
+	b.WriteString(msg)
+
+	eachField(kv, func(key string, value interface{}) {
+		s := fmt.Sprint(value)
+		if (len(s) == 0) || strings.ContainsAny(s, " =\"\n") {
+			s = strconv.Quote(s)
+		}
+
+		b.WriteString(" " + key + "=" + s)
+	})
+	b.WriteString("\n")
+
+	return []byte(b.String())
+}
+
+// JSON line: {"time":"...","level":"warning","pkg":"...","caller":"...","msg":"...","key":value}
+func encodeJSON(level byte, pkg string, caller string, msg string, kv []interface{}) []byte {
+	var b strings.Builder
+
+	put := func(key string, value interface{}) {
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(value)
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(value))
+		}
+
+		b.WriteString(",")
+		b.Write(k)
+		b.WriteString(":")
+		b.Write(v)
+	}
+
+	b.WriteString("{")
+	t, _ := json.Marshal(time.Now().Format(time.RFC3339Nano))
+	b.WriteString(`"time":`)
+	b.Write(t)
+	put("level", levelJSON[level])
+	if len(pkg) > 0 {
+		put("pkg", pkg)
+	}
+	if len(caller) > 0 {
+		put("caller", caller)
+	}
+	put("msg", msg)
+	eachField(kv, put)
+	b.WriteString("}\n")
+
+	return []byte(b.String())
+}
+
+// Caller file and line, skip frames above caller
+func callerOf(skip int) (string, uintptr) {
+	pc, file, line, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return "", 0
+	}
+
+	return filepath.Base(file) + ":" + strconv.Itoa(line), pc
+}
+
+// Package name of function, "lwmq/dispatcher.(*MQTTserver).PubWill" is "dispatcher"
+func packageOf(pc uintptr) string {
+	fn := runtime.FuncForPC(pc)
+	if fn == nil {
+		return ""
+	}
+
+	name := fn.Name()
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	if i := strings.Index(name, "."); i >= 0 {
+		name = name[:i]
+	}
+
+	return name
+}
+
+// Log of compatible calls, package is found from caller
+func logv(level byte, v []interface{}) {
+	if !mlog.anyEnabled(level) {
+		return
+	}
+
+	caller, pc := callerOf(2)
+	pkg := packageOf(pc)
+	if !mlog.enabled(pkg, level) {
+		return
+	}
+
+	if level < WARNING {
+		caller = ""
+	}
+
+	msg := strings.TrimSuffix(fmt.Sprintln(v...), "\n")
+	mlog.write(level, pkg, caller, msg, nil)
 }
 
 // Info print info log
 func Info(v ...interface{}) {
-	if INFO >= mlog.logLevel {
-		mlog.info.Println(v...)
-	}
+	logv(INFO, v)
 }
 
 // Debug print debug log
 func Debug(v ...interface{}) {
-	if DEBUG >= mlog.logLevel {
-		mlog.debug.Println(v...)
-	}
+	logv(DEBUG, v)
 }
 
 // Warning print warning log
 func Warning(v ...interface{}) {
-	if WARNING >= mlog.logLevel {
-		mlog.warning.Println(v...)
-	}
+	logv(WARNING, v)
 }
 
 // Error print error log
 func Error(v ...interface{}) {
-	if ERROR >= mlog.logLevel {
-		mlog.err.Println(v...)
-	}
+	logv(ERROR, v)
 }
 
 func init() {
 	mlog = &Mlog{
-		logLevel: INFO,
-		info:     log.New(os.Stdout, "[I] ", log.Ldate|log.Ltime),
-		debug:    log.New(os.Stdout, "[D] ", log.Ldate|log.Ltime),
-		warning:  log.New(os.Stdout, "[W] ", log.Ldate|log.Ltime|log.Lshortfile),
-		err:      log.New(os.Stdout, "[E] ", log.Ldate|log.Ltime|log.Lshortfile),
+		minLevel:  DEBUG,
+		pkgLevels: make(map[string]byte),
+		format:    FormatText,
+		writer:    os.Stdout,
+		lock:      new(sync.RWMutex),
+		wlock:     new(sync.Mutex),
 	}
 }
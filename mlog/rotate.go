@@ -0,0 +1,119 @@
+package mlog
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// RotateFile log file rotated by size, path.1 is the newest backup
+type RotateFile struct {
+	path       string
+	maxSize    int64 // Rotate when file is bigger, 0 never rotates
+	maxBackups int   // Backups kept, older ones are removed
+	file       *os.File
+	size       int64
+	closed     bool
+	fallback   io.Writer // Written when file can not be opened, os.Stderr
+	lock       *sync.Mutex
+}
+
+// OpenRotateFile open log file for append
+func OpenRotateFile(path string, maxSize int64, maxBackups int) (*RotateFile, error) {
+	r := &RotateFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+		fallback:   os.Stderr,
+		lock:       new(sync.Mutex),
+	}
+
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Open file and get its size
+func (r *RotateFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	r.file = file
+	r.size = info.Size()
+
+	return nil
+}
+
+// Rename path.N-1 to path.N, ..., path to path.1, then open new file
+func (r *RotateFile) rotate() error {
+	r.file.Close()
+	r.file = nil
+	r.size = 0
+
+	if r.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxBackups))
+		for i := r.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		os.Rename(r.path, r.path+".1")
+	} else {
+		os.Remove(r.path)
+	}
+
+	return r.open()
+}
+
+// Write write log line, file is rotated before it gets bigger than max size.
+// If file can not be opened again, lines go to stderr until it can
+func (r *RotateFile) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return 0, fmt.Errorf("log file %s closed", r.path)
+	}
+
+	if r.file == nil {
+		if r.open() != nil {
+			return r.fallback.Write(p)
+		}
+		fmt.Fprintf(r.fallback, "Log file %s opened again\n", r.path)
+	} else if (r.maxSize > 0) && (r.size > 0) && (r.size+int64(len(p)) > r.maxSize) {
+		if err := r.rotate(); err != nil {
+			fmt.Fprintf(r.fallback, "Rotate log file error: %v, log to stderr\n", err)
+			return r.fallback.Write(p)
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+
+	return n, err
+}
+
+// Close close log file
+func (r *RotateFile) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.closed = true
+	if r.file == nil {
+		return nil
+	}
+
+	err := r.file.Close()
+	r.file = nil
+
+	return err
+}
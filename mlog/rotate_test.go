@@ -0,0 +1,87 @@
+package mlog
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readLog(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(data)
+}
+
+func TestRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lwmq.log")
+	r, err := OpenRotateFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for _, line := range []string{"a1234567\n", "b1234567\n", "c1234567\n", "d1234567\n"} {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for suffix, want := range map[string]string{"": "d1234567\n", ".1": "c1234567\n", ".2": "b1234567\n"} {
+		if got := readLog(t, path+suffix); got != want {
+			t.Errorf("log%s %q, want %q", suffix, got, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("backup 3 kept: %v", err)
+	}
+}
+
+func TestRotateFallback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lwmq.log")
+	r, err := OpenRotateFile(path, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stderr bytes.Buffer
+	r.fallback = &stderr
+
+	r.Write([]byte("a1234567\n"))
+
+	// Log path can not be removed nor opened as file
+	os.Remove(path)
+	if err := os.MkdirAll(filepath.Join(path, "dir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"b1234567\n", "c1234567\n"} {
+		if n, err := r.Write([]byte(line)); (err != nil) || (n != len(line)) {
+			t.Fatalf("write %d %v while file can not be opened", n, err)
+		}
+	}
+	if got := stderr.String(); !strings.Contains(got, "Rotate log file error") ||
+		!strings.HasSuffix(got, "b1234567\nc1234567\n") {
+		t.Fatalf("stderr %q", got)
+	}
+
+	// File is opened again when it can be
+	os.RemoveAll(path)
+	stderr.Reset()
+	r.Write([]byte("d1234567\n"))
+	if got := readLog(t, path); got != "d1234567\n" {
+		t.Fatalf("log %q after reopen", got)
+	}
+	if got := stderr.String(); !strings.Contains(got, "opened again") {
+		t.Fatalf("stderr %q", got)
+	}
+
+	r.Close()
+	if _, err := r.Write([]byte("e\n")); err == nil {
+		t.Fatal("write after close")
+	}
+}
@@ -0,0 +1,123 @@
+package mtopic
+
+import (
+	"strings"
+)
+
+// Topic limits
+const (
+	Separator    = "/"
+	SingleLevel  = "+"
+	MultiLevel   = "#"
+	maxTopicSize = 65535
+)
+
+// ValidName check topic name used by PUBLISH, MQTT-4.7.3
+func ValidName(name string) bool {
+	if len(name) == 0 || len(name) > maxTopicSize {
+		return false
+	}
+
+	return !strings.ContainsAny(name, "+#\x00")
+}
+
+// ValidFilter check topic filter used by SUBSCRIBE, MQTT-4.7.1
+func ValidFilter(filter string) bool {
+	if len(filter) == 0 || len(filter) > maxTopicSize {
+		return false
+	}
+
+	if strings.Contains(filter, "\x00") {
+		return false
+	}
+
+	levels := strings.Split(filter, Separator)
+	for i, level := range levels {
+		if strings.Contains(level, MultiLevel) {
+			// '#' must occupy a whole level and be the last one
+			if level != MultiLevel || i != len(levels)-1 {
+				return false
+			}
+		} else if strings.Contains(level, SingleLevel) {
+			// '+' must occupy a whole level
+			if level != SingleLevel {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// Match check if topic name matches topic filter
+func Match(filter string, name string) bool {
+	if len(filter) == 0 || len(name) == 0 {
+		return false
+	}
+
+	// Topics start with '$' not match wildcards at first level, MQTT-4.7.2
+	if name[0] == '$' && (filter[0] == '+' || filter[0] == '#') {
+		return false
+	}
+
+	filterLevels := strings.Split(filter, Separator)
+	nameLevels := strings.Split(name, Separator)
+
+	for i, level := range filterLevels {
+		if level == MultiLevel {
+			// '#' also matches the parent level, "a/#" matches "a"
+			return true
+		}
+
+		if i >= len(nameLevels) {
+			return false
+		}
+
+		if level != SingleLevel && level != nameLevels[i] {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(nameLevels)
+}
+
+// Contains check if every topic matched by sub filter is also matched by filter
+func Contains(filter string, sub string) bool {
+	if len(filter) == 0 || len(sub) == 0 {
+		return false
+	}
+
+	// Sub filter matches '$' topics only, not matched by wildcards at first level
+	if sub[0] == '$' && (filter[0] == '+' || filter[0] == '#') {
+		return false
+	}
+
+	filterLevels := strings.Split(filter, Separator)
+	subLevels := strings.Split(sub, Separator)
+
+	for i, level := range filterLevels {
+		if level == MultiLevel {
+			return true
+		}
+
+		if i >= len(subLevels) {
+			return false
+		}
+
+		subLevel := subLevels[i]
+		if subLevel == MultiLevel {
+			// Sub filter matches more levels than filter
+			return false
+		}
+
+		if level == SingleLevel {
+			continue
+		}
+
+		if subLevel == SingleLevel || subLevel != level {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(subLevels)
+}
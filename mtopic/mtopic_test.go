@@ -0,0 +1,154 @@
+package mtopic
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidName(t *testing.T) {
+	cases := []struct {
+		name  string
+		valid bool
+	}{
+		{"a", true},
+		{"a/b/c", true},
+		{"/", true},
+		{"a//b", true},
+		{"/a/", true},
+		{"$SYS/broker/uptime", true},
+		{"", false},
+		{"a/+", false},
+		{"a/#", false},
+		{"a+b", false},
+		{"a\x00b", false},
+		{strings.Repeat("a", maxTopicSize), true},
+		{strings.Repeat("a", maxTopicSize+1), false},
+	}
+
+	for _, c := range cases {
+		if got := ValidName(c.name); got != c.valid {
+			t.Errorf("ValidName(%q) = %v, want %v", c.name, got, c.valid)
+		}
+	}
+}
+
+func TestValidFilter(t *testing.T) {
+	cases := []struct {
+		filter string
+		valid  bool
+	}{
+		{"a/b", true},
+		{"+", true},
+		{"#", true},
+		{"+/+", true},
+		{"a/+/c", true},
+		{"a/#", true},
+		{"+/#", true},
+		{"/", true},
+		{"a//b", true},
+		{"//#", true},
+		{"$SYS/#", true},
+		{"", false},
+		{"a/#/c", false},
+		{"#/a", false},
+		{"a#", false},
+		{"a/b#", false},
+		{"a+", false},
+		{"a/+b/c", false},
+		{"++", false},
+		{"a\x00", false},
+	}
+
+	for _, c := range cases {
+		if got := ValidFilter(c.filter); got != c.valid {
+			t.Errorf("ValidFilter(%q) = %v, want %v", c.filter, got, c.valid)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		filter string
+		name   string
+		match  bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/b", "a/b/c", false},
+		{"a/b/c", "a/b", false},
+		{"a/b", "A/b", false},
+
+		// Single level
+		{"+", "a", true},
+		{"+", "a/b", false},
+		{"+", "/a", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/+", "a", false},
+		{"a/+/c", "a/b/c", true},
+		{"a/+/c", "a/b/d", false},
+		{"+/+", "/a", true},
+		{"+/+", "a/", true},
+
+		// Multi level
+		{"#", "a", true},
+		{"#", "a/b/c", true},
+		{"#", "/", true},
+		{"a/#", "a", true},
+		{"a/#", "a/b", true},
+		{"a/#", "a/b/c", true},
+		{"a/#", "b/a", false},
+		{"a/+/#", "a/b", true},
+		{"a/+/#", "a", false},
+
+		// Empty levels
+		{"/", "/", true},
+		{"a//b", "a//b", true},
+		{"a/+/b", "a//b", true},
+		{"+", "", false},
+		{"/+", "/", true},
+		{"a/b", "a/b/", false},
+		{"a/b/+", "a/b/", true},
+
+		// Topics starting with '$', MQTT-4.7.2
+		{"#", "$SYS/broker/uptime", false},
+		{"+/broker/uptime", "$SYS/broker/uptime", false},
+		{"+", "$SYS", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+		{"$SYS/+/uptime", "$SYS/broker/uptime", true},
+		{"$SYS", "$SYS", true},
+		{"a/#", "a/$SYS", true},
+		{"a/+", "a/$b", true},
+	}
+
+	for _, c := range cases {
+		if got := Match(c.filter, c.name); got != c.match {
+			t.Errorf("Match(%q, %q) = %v, want %v", c.filter, c.name, got, c.match)
+		}
+	}
+}
+
+func TestContains(t *testing.T) {
+	cases := []struct {
+		filter   string
+		sub      string
+		contains bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/+", "a/b", true},
+		{"a/+", "a/+", true},
+		{"a/b", "a/+", false},
+		{"a/#", "a/b/+", true},
+		{"a/#", "a/#", true},
+		{"a/+", "a/#", false},
+		{"#", "a/#", true},
+		{"#", "$SYS/#", false},
+		{"$SYS/#", "$SYS/broker", true},
+	}
+
+	for _, c := range cases {
+		if got := Contains(c.filter, c.sub); got != c.contains {
+			t.Errorf("Contains(%q, %q) = %v, want %v", c.filter, c.sub, got, c.contains)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package service
+
+import (
+	"fmt"
+	"lwmq/mlog"
+	"sync"
+)
+
+// DefaultCidCapacity default max connections of all services
+const DefaultCidCapacity = 65536
+
+// CidPool connection ids, cid is the key of client manager. Free ids are
+// reused in FIFO order, so a freed id is the last one to be allocated again
+// and late requests of a dead connection do not land on a new client
+type CidPool struct {
+	free    []uint32 // Ring of free ids
+	head    int      // Index of next id to alloc
+	count   int      // Count of free ids
+	used    []bool
+	pending int // Capacity of deferred shrink, 0 if none
+	high    int // Used ids not less than pending capacity
+	lock    *sync.Mutex
+}
+
+// Alloc alloc one cid, fail if all ids are used
+func (p *CidPool) Alloc() (uint32, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.count == 0 {
+		return 0, false
+	}
+
+	if p.pending > 0 {
+		if len(p.used)-p.count >= p.pending {
+			return 0, false
+		}
+
+		// Skip ids removed by shrink, a free one below it exists
+		for p.free[p.head] >= uint32(p.pending) {
+			p.free[(p.head+p.count)%len(p.free)] = p.free[p.head]
+			p.head = (p.head + 1) % len(p.free)
+		}
+	}
+
+	cid := p.free[p.head]
+	p.head = (p.head + 1) % len(p.free)
+	p.count--
+	p.used[cid] = true
+
+	return cid, true
+}
+
+// Free put cid back to tail of free ids
+func (p *CidPool) Free(cid uint32) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if (int(cid) >= len(p.used)) || !p.used[cid] {
+		mlog.Error("Free unused cid:", cid)
+		return
+	}
+
+	p.used[cid] = false
+	p.free[(p.head+p.count)%len(p.free)] = cid
+	p.count++
+
+	if (p.pending > 0) && (int(cid) >= p.pending) {
+		if p.high--; p.high == 0 {
+			mlog.Warning("Deferred cid capacity applied:", p.pending)
+			p.resize(p.pending)
+		}
+	}
+}
+
+// Capacity get max count of cid
+func (p *CidPool) Capacity() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.pending > 0 {
+		return p.pending
+	}
+
+	return len(p.used)
+}
+
+// Used get count of allocated cid
+func (p *CidPool) Used() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return len(p.used) - p.count
+}
+
+// Pending get capacity of deferred shrink, 0 if none
+func (p *CidPool) Pending() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.pending
+}
+
+// SetCapacity change max count of cid. Shrinking below a used id is
+// deferred: the new limit applies to Alloc at once, and ids above it are
+// removed when all of them are freed, see Pending
+func (p *CidPool) SetCapacity(capacity int) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if capacity <= 0 {
+		return fmt.Errorf("cid capacity %d must be positive", capacity)
+	}
+
+	p.pending = 0
+	p.high = 0
+	for cid := capacity; cid < len(p.used); cid++ {
+		if p.used[cid] {
+			p.high++
+		}
+	}
+
+	if p.high > 0 {
+		p.pending = capacity
+		return nil
+	}
+
+	p.resize(capacity)
+	return nil
+}
+
+// Change capacity when no id above it is used, lock must be held
+func (p *CidPool) resize(capacity int) {
+	old := len(p.used)
+
+	// Keep order of free ids, new ids are appended
+	free := make([]uint32, capacity)
+	n := 0
+	for i := 0; (i < p.count) && (n < capacity); i++ {
+		cid := p.free[(p.head+i)%len(p.free)]
+		if int(cid) < capacity {
+			free[n] = cid
+			n++
+		}
+	}
+	for cid := old; cid < capacity; cid++ {
+		free[n] = uint32(cid)
+		n++
+	}
+
+	used := make([]bool, capacity)
+	copy(used, p.used)
+
+	p.free = free
+	p.head = 0
+	p.count = n
+	p.used = used
+	p.pending = 0
+	p.high = 0
+}
+
+// NewCidPool create pool of ids 0 to capacity-1
+func NewCidPool(capacity int) *CidPool {
+	p := &CidPool{lock: new(sync.Mutex)}
+	if err := p.SetCapacity(capacity); err != nil {
+		p.SetCapacity(DefaultCidCapacity)
+	}
+
+	return p
+}
+
+// Cids cid pool shared by all services
+var Cids = NewCidPool(DefaultCidCapacity)
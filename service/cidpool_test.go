@@ -0,0 +1,170 @@
+package service
+
+import (
+	"testing"
+)
+
+func allocCids(t *testing.T, p *CidPool, n int) []uint32 {
+	var cids []uint32
+	for i := 0; i < n; i++ {
+		cid, ok := p.Alloc()
+		if !ok {
+			t.Fatalf("alloc %d of %d failed", i, n)
+		}
+		cids = append(cids, cid)
+	}
+
+	return cids
+}
+
+func TestCidFIFO(t *testing.T) {
+	p := NewCidPool(4)
+
+	cids := allocCids(t, p, 3)
+	for i, cid := range cids {
+		if cid != uint32(i) {
+			t.Fatalf("cids %v, want 0, 1, 2", cids)
+		}
+	}
+
+	// Freed ids are allocated after all other free ids
+	p.Free(1)
+	p.Free(0)
+	for _, want := range []uint32{3, 1, 0} {
+		if cid, ok := p.Alloc(); !ok || (cid != want) {
+			t.Fatalf("alloc %d %v, want %d", cid, ok, want)
+		}
+	}
+	if used := p.Used(); used != 4 {
+		t.Fatalf("used %d, want 4", used)
+	}
+}
+
+func TestCidExhausted(t *testing.T) {
+	p := NewCidPool(2)
+	allocCids(t, p, 2)
+
+	if _, ok := p.Alloc(); ok {
+		t.Fatal("alloc from exhausted pool")
+	}
+
+	p.Free(1)
+	if cid, ok := p.Alloc(); !ok || (cid != 1) {
+		t.Fatalf("alloc %d %v after free, want 1", cid, ok)
+	}
+
+	// Double and unknown free are ignored
+	p.Free(0)
+	p.Free(0)
+	p.Free(5)
+	if used := p.Used(); used != 1 {
+		t.Fatalf("used %d, want 1", used)
+	}
+
+	if p := NewCidPool(0); p.Capacity() != DefaultCidCapacity {
+		t.Fatalf("capacity %d of invalid pool, want default", p.Capacity())
+	}
+}
+
+func TestCidSetCapacity(t *testing.T) {
+	p := NewCidPool(2)
+	allocCids(t, p, 2)
+
+	if err := p.SetCapacity(0); err == nil {
+		t.Fatal("capacity 0 accepted")
+	}
+
+	// Grow keeps used ids
+	if err := p.SetCapacity(4); err != nil {
+		t.Fatal(err)
+	}
+	if cids := allocCids(t, p, 2); (cids[0] != 2) || (cids[1] != 3) {
+		t.Fatalf("cids %v after grow, want 2 and 3", cids)
+	}
+	if (p.Capacity() != 4) || (p.Used() != 4) {
+		t.Fatalf("capacity %d used %d, want 4 and 4", p.Capacity(), p.Used())
+	}
+
+	// Shrink above used ids is applied at once
+	p.Free(3)
+	p.Free(2)
+	if err := p.SetCapacity(2); err != nil {
+		t.Fatal(err)
+	}
+	if (p.Pending() != 0) || (p.Capacity() != 2) {
+		t.Fatalf("pending %d capacity %d, want 0 and 2", p.Pending(), p.Capacity())
+	}
+	if _, ok := p.Alloc(); ok {
+		t.Fatal("alloc beyond shrunk capacity")
+	}
+}
+
+func TestCidDeferredShrink(t *testing.T) {
+	p := NewCidPool(6)
+	allocCids(t, p, 5)
+	p.Free(0)
+	p.Free(1)
+	p.Free(2)
+
+	// Ids 3 and 4 are used
+	if err := p.SetCapacity(2); err != nil {
+		t.Fatal(err)
+	}
+	if (p.Pending() != 2) || (p.Capacity() != 2) {
+		t.Fatalf("pending %d capacity %d, want 2 and 2", p.Pending(), p.Capacity())
+	}
+
+	// Limit applies to alloc at once
+	if _, ok := p.Alloc(); ok {
+		t.Fatal("alloc while used ids exceed pending capacity")
+	}
+
+	p.Free(4)
+	if p.Pending() != 2 {
+		t.Fatal("shrink applied while id 3 used")
+	}
+	// Id 5 is free but removed by shrink
+	if cid, ok := p.Alloc(); !ok || (cid != 0) {
+		t.Fatalf("alloc %d %v, want 0", cid, ok)
+	}
+	if _, ok := p.Alloc(); ok {
+		t.Fatal("alloc beyond pending capacity")
+	}
+
+	p.Free(3)
+	if (p.Pending() != 0) || (p.Capacity() != 2) || (p.Used() != 1) {
+		t.Fatalf("pending %d capacity %d used %d, want 0, 2 and 1", p.Pending(), p.Capacity(), p.Used())
+	}
+	if cid, ok := p.Alloc(); !ok || (cid != 1) {
+		t.Fatalf("alloc %d %v after shrink, want 1", cid, ok)
+	}
+	if _, ok := p.Alloc(); ok {
+		t.Fatal("alloc beyond shrunk capacity")
+	}
+}
+
+func TestCidCancelShrink(t *testing.T) {
+	p := NewCidPool(4)
+	allocCids(t, p, 4)
+
+	if err := p.SetCapacity(1); err != nil {
+		t.Fatal(err)
+	}
+	if p.Pending() != 1 {
+		t.Fatalf("pending %d, want 1", p.Pending())
+	}
+
+	// Grow cancels pending shrink, no id is lost
+	if err := p.SetCapacity(5); err != nil {
+		t.Fatal(err)
+	}
+	if (p.Pending() != 0) || (p.Capacity() != 5) {
+		t.Fatalf("pending %d capacity %d, want 0 and 5", p.Pending(), p.Capacity())
+	}
+	for cid := uint32(0); cid < 4; cid++ {
+		p.Free(cid)
+	}
+	if cids := allocCids(t, p, 5); cids[0] != 4 {
+		t.Fatalf("cids %v, want 4 first", cids)
+	}
+}
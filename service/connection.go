@@ -1,6 +1,9 @@
 package service
 
 import (
+	"crypto/tls"
+	"errors"
+	"io"
 	"lwmq/iface"
 	"lwmq/mlog"
 	"net"
@@ -9,17 +12,29 @@ import (
 
 // Connection as a connection
 type Connection struct {
-	Server iface.Iservicer
-	Conn   *net.TCPConn
-	cid    uint32
-	lock   *sync.Mutex
+	Server   iface.Iservicer
+	Conn     net.Conn
+	cid      uint32
+	certName string
+	listener string // Name of service accepted the connection
+	remote   string // Remote address of client
+	log      *mlog.Logger
+	onClose  func() // Called once when connection is closed
+	lock     *sync.Mutex
+	once     *sync.Once
+	closed   chan struct{} // Closed when connection is closed
 }
 
 // Read read data from connection
 func (c *Connection) Read(buff []byte, size uint32) (uint32, error) {
 	len, err := c.Conn.Read(buff)
 	if err != nil {
-		mlog.Error("Read error:", err)
+		// Closed by client or by broker is not a failure
+		if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+			c.log.Debug("Read closed", "err", err)
+		} else {
+			c.log.Error("Read error", "err", err)
+		}
 		return 0, err
 	}
 
@@ -31,15 +46,23 @@ func (c *Connection) Write(buff []byte, size uint32) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	mlog.Debug("Write data")
+	c.log.Debug("Write data", "size", len(buff))
 
 	c.Conn.Write(buff)
 }
 
 // Close close connection
 func (c *Connection) Close() {
-	mlog.Debug("Connection closed")
+	c.log.Debug("Connection closed")
 	c.Conn.Close()
+
+	c.once.Do(func() {
+		close(c.closed)
+
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
 }
 
 // FreeCid free cid
@@ -47,12 +70,46 @@ func (c *Connection) FreeCid() {
 	c.Server.FreeCid(c.cid)
 }
 
+// GetCertName get common name of verified client certificate
+func (c *Connection) GetCertName() string {
+	return c.certName
+}
+
+// GetListener get name of service accepted the connection
+func (c *Connection) GetListener() string {
+	return c.listener
+}
+
+// GetRemote get remote address of client
+func (c *Connection) GetRemote() string {
+	return c.remote
+}
+
+// Get common name of verified client certificate
+func peerCertName(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
+
 // NewConn new connection
-func NewConn(server iface.Iservicer, conn *net.TCPConn, cid uint32) iface.Iconn {
+func NewConn(server iface.Iservicer, conn net.Conn, cid uint32) iface.Iconn {
 	return &Connection{
 		Server: server,
 		Conn:   conn,
 		cid:    cid,
+		remote: conn.RemoteAddr().String(),
+		log:    logger.With("cid", cid),
 		lock:   new(sync.Mutex),
+		once:   new(sync.Once),
+		closed: make(chan struct{}),
 	}
 }
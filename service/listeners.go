@@ -0,0 +1,123 @@
+package service
+
+import (
+	"fmt"
+	"lwmq/iface"
+	"sync"
+)
+
+// Listeners services of one broker, all share client manager and MQTT server
+type Listeners struct {
+	services map[string]*Lwmq
+	names    []string // Names in order of adding
+	lock     *sync.Mutex
+}
+
+// Add add service, name of service must be unique
+func (l *Listeners) Add(s *Lwmq) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if _, exist := l.services[s.Name]; exist {
+		return fmt.Errorf("listener %q exists", s.Name)
+	}
+
+	l.services[s.Name] = s
+	l.names = append(l.names, s.Name)
+
+	return nil
+}
+
+// Get get service by name
+func (l *Listeners) Get(name string) *Lwmq {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.services[name]
+}
+
+// List get all services in order of adding
+func (l *Listeners) List() []*Lwmq {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	list := make([]*Lwmq, 0, len(l.names))
+	for _, name := range l.names {
+		list = append(list, l.services[name])
+	}
+
+	return list
+}
+
+// SetOnConnect set connect callback of all services
+func (l *Listeners) SetOnConnect(onConn func(cid uint32, conn iface.Iconn)) {
+	for _, s := range l.List() {
+		s.SetOnConnect(onConn)
+	}
+}
+
+// Start start one service by name
+func (l *Listeners) Start(name string) error {
+	s := l.Get(name)
+	if s == nil {
+		return fmt.Errorf("listener %q not found", name)
+	}
+
+	return s.Start()
+}
+
+// Stop stop one service by name
+func (l *Listeners) Stop(name string) error {
+	s := l.Get(name)
+	if s == nil {
+		return fmt.Errorf("listener %q not found", name)
+	}
+
+	s.Stop()
+	return nil
+}
+
+// StartAll start all services, started services are stopped if one fails
+func (l *Listeners) StartAll() error {
+	list := l.List()
+
+	for i, s := range list {
+		if err := s.Start(); err != nil {
+			for _, started := range list[:i] {
+				started.Stop()
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// StopAll stop all services
+func (l *Listeners) StopAll() {
+	for _, s := range l.List() {
+		s.Stop()
+	}
+}
+
+// StopAccept close listeners of all services, connections are kept open
+func (l *Listeners) StopAccept() {
+	for _, s := range l.List() {
+		s.StopAccept()
+	}
+}
+
+// CloseConns close connections of all services stopped accepting
+func (l *Listeners) CloseConns() {
+	for _, s := range l.List() {
+		s.CloseConns()
+	}
+}
+
+// NewListeners create empty service group
+func NewListeners() *Listeners {
+	return &Listeners{
+		services: make(map[string]*Lwmq),
+		lock:     new(sync.Mutex),
+	}
+}
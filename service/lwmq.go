@@ -1,11 +1,16 @@
 package service
 
 import (
+	"crypto/tls"
 	"fmt"
+	"io"
 	"lwmq/iface"
 	"lwmq/mlog"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 var lwmqStart = `
@@ -19,74 +24,238 @@ var lwmqStart = `
 ---------------------------------------
 `
 
-func init() {
+// Version of LWMQ
+const Version = "1.0.0"
+
+// PrintBanner print banner of LWMQ
+func PrintBanner() {
 	fmt.Println(lwmqStart)
+	fmt.Println("LWMQ version", Version)
 }
 
-// Lwmq service
+var logger = mlog.New("service")
+
+// Lwmq service, one listener of broker
 type Lwmq struct {
-	Name    string
-	Type    string
-	IP      string
-	Port    int
-	onConn  func(cid uint32, conn iface.Iconn)
+	Name string
+	Type string
+	IP   string
+	Port int
+	TLS  *TLSConfig // Used by "tls" type
+	Path string     // URL path of "ws" type
+	// Idle timeout of "udp" type, virtual connection is closed if no datagram
+	IdleTimeout time.Duration
+	// Max connections of this listener, 0 is no limit
+	MaxConns int
+	onConn   func(cid uint32, conn iface.Iconn)
+
+	running bool
+	closer  io.Closer     // Listener of running service
+	quit    chan struct{} // Closed when service stops
+	conns   map[uint32]*Connection
 	lock    *sync.Mutex
-	cidPool []byte
 }
 
-// Start start service
-func (s *Lwmq) Start() {
-	mlog.Debug("Start LWMQ service!")
+// Listen address, IPv6 address is bracketed
+func (s *Lwmq) address() string {
+	return net.JoinHostPort(s.IP, strconv.Itoa(s.Port))
+}
 
-	go func() {
-		switch s.Type {
-		case "tcp", "tcp4":
-			addr, err := net.ResolveTCPAddr(s.Type, fmt.Sprintf("%s:%d", s.IP, s.Port))
-			if err != nil {
-				mlog.Error("Resolve address error:", err)
-				return
-			}
+// Start start service, listen and accept connections in background
+func (s *Lwmq) Start() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
-			listener, err := net.ListenTCP(s.Type, addr)
-			if err != nil {
-				mlog.Error("Listen address error:", err)
-				return
-			}
+	if s.running {
+		return nil
+	}
+	if s.closer != nil {
+		return fmt.Errorf("service %s is stopping, connections are not closed", s.Name)
+	}
 
-			mlog.Debug("Listen on:", addr.String())
+	mlog.Debug("Start LWMQ service:", s.Name)
 
-			// Loop wait for connection
-			for {
-				conn, err := listener.AcceptTCP()
-				if err != nil {
-					mlog.Error("Accept error:", err)
-					continue
-				}
+	var serve func(quit chan struct{})
+	var err error
 
-				// Alloc one Cid, every connection has different Cid
-				cid, sts := s.AllocCid()
-				if sts != 0 {
-					conn.Close()
-					continue
-				}
+	switch s.Type {
+	case "tcp", "tcp4", "tcp6":
+		serve, err = s.listenTCP()
+	case "tls":
+		serve, err = s.listenTLS()
+	case "ws":
+		serve, err = s.listenWebSocket()
+	case "udp", "udp4", "udp6":
+		serve, err = s.listenUDP()
+	default:
+		err = fmt.Errorf("address type error: %s", s.Type)
+	}
+
+	if err != nil {
+		mlog.Error("Start service error:", s.Name, " ", err)
+		return err
+	}
+
+	s.running = true
+	s.quit = make(chan struct{})
+	go serve(s.quit)
+
+	return nil
+}
+
+// Listen TCP, "tcp" with empty or "::" IP listens on IPv4 and IPv6, dual stack
+func (s *Lwmq) listenTCP() (func(quit chan struct{}), error) {
+	addr, err := net.ResolveTCPAddr(s.Type, s.address())
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.ListenTCP(s.Type, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mlog.Debug("Listen on:", addr.String())
+
+	s.closer = listener
+	return func(quit chan struct{}) { s.serve(listener, quit) }, nil
+}
+
+// Listen TLS
+func (s *Lwmq) listenTLS() (func(quit chan struct{}), error) {
+	config, err := s.TLS.newConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := tls.Listen("tcp", s.address(), config)
+	if err != nil {
+		return nil, err
+	}
 
-				mlog.Debug("Get connect:", conn.RemoteAddr().String())
+	mlog.Debug("Listen TLS on:", listener.Addr().String())
 
-				// Get connection and run callback
-				connection := NewConn(s, conn, cid)
-				s.onConn(cid, connection)
+	s.closer = listener
+	return func(quit chan struct{}) { s.serve(listener, quit) }, nil
+}
+
+// Loop wait for connection until service stops
+func (s *Lwmq) serve(listener net.Listener, quit chan struct{}) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-quit:
+				return
+			default:
 			}
-		case "tcp6":
 
-		case "udp":
+			mlog.Error("Accept error:", err)
+			continue
+		}
 
-		default:
-			mlog.Error("Address type error!")
-			return
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			// Handshake before reading MQTT data, client certificate is needed
+			go s.handshake(tlsConn)
+			continue
 		}
-	}()
 
-	select {}
+		s.accept(conn, conn.RemoteAddr().String(), "")
+	}
+}
+
+// Finish TLS handshake then accept connection
+func (s *Lwmq) handshake(conn *tls.Conn) {
+	conn.SetDeadline(time.Now().Add(s.TLS.handshakeTimeout()))
+	if err := conn.Handshake(); err != nil {
+		mlog.Error("TLS handshake error:", conn.RemoteAddr().String(), " ", err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	certName := ""
+	if s.TLS.CertNameAsUser {
+		certName = peerCertName(conn)
+	}
+
+	s.accept(conn, conn.RemoteAddr().String(), certName)
+}
+
+// Alloc cid and run connect callback
+func (s *Lwmq) accept(conn net.Conn, remote string, certName string) *Connection {
+	s.lock.Lock()
+
+	if !s.running {
+		s.lock.Unlock()
+		conn.Close()
+		return nil
+	}
+
+	if (s.MaxConns > 0) && (len(s.conns) >= s.MaxConns) {
+		s.lock.Unlock()
+		logger.Warning("Too many connections, reject", "listener", s.Name, "remote", remote, "max", s.MaxConns)
+		conn.Close()
+		return nil
+	}
+
+	// Alloc one Cid, every connection has different Cid
+	cid, sts := s.AllocCid()
+	if sts != 0 {
+		s.lock.Unlock()
+		logger.Warning("Connection ids exhausted, reject", "listener", s.Name, "remote", remote, "capacity", Cids.Capacity())
+		conn.Close()
+		return nil
+	}
+
+	connection := NewConn(s, conn, cid).(*Connection)
+	connection.certName = certName
+	connection.listener = s.Name
+	connection.remote = remote
+	connection.log = logger.With("cid", cid, "remote", remote, "listener", s.Name)
+	connection.onClose = func() { s.removeConn(cid) }
+	s.conns[cid] = connection
+
+	s.lock.Unlock()
+
+	connection.log.Debug("Get connect")
+
+	// Run callback
+	s.onConn(cid, connection)
+
+	return connection
+}
+
+// Remove closed connection of service
+func (s *Lwmq) removeConn(cid uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.conns, cid)
+}
+
+// SetMaxConns change max connections, existing connections are kept
+func (s *Lwmq) SetMaxConns(maxConns int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.MaxConns = maxConns
+}
+
+// GetConnCount get count of connections of service
+func (s *Lwmq) GetConnCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.conns)
+}
+
+// IsRunning check if service is listening
+func (s *Lwmq) IsRunning() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.running
 }
 
 // SetOnConnect on connect callback
@@ -94,47 +263,120 @@ func (s *Lwmq) SetOnConnect(onConn func(cid uint32, conn iface.Iconn)) {
 	s.onConn = onConn
 }
 
-// AllocCid alloc cid
+// AllocCid alloc cid from pool shared by all services
 func (s *Lwmq) AllocCid() (uint32, byte) {
-	var i uint32 = 0
+	cid, ok := Cids.Alloc()
+	if !ok {
+		return 0, 0x10
+	}
+
+	return cid, 0
+}
+
+// FreeCid free cid
+func (s *Lwmq) FreeCid(cid uint32) {
+	Cids.Free(cid)
+}
+
+// Check if service reads datagrams of all connections from one socket
+func (s *Lwmq) isUDP() bool {
+	return strings.HasPrefix(s.Type, "udp")
+}
+
+// Stop stop service, close listener and connections of this service
+func (s *Lwmq) Stop() {
+	s.StopAccept()
+	s.CloseConns()
+}
+
+// StopAccept close listener, connections of this service are kept open until
+// CloseConns. Socket of UDP service is kept to serve connections, datagrams
+// of new remote addresses are dropped
+func (s *Lwmq) StopAccept() {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	for i = 0; i < 1024; i++ {
-		if s.cidPool[i] != 0x01 {
-			break
-		}
+	if !s.running {
+		return
 	}
 
-	if i >= 1024 {
-		return 0, 0x10
+	s.running = false
+	if !s.isUDP() {
+		close(s.quit)
+		s.closer.Close()
+		s.closer = nil
 	}
 
-	s.cidPool[i] = 0x01
-	return i, 0
+	mlog.Warning("Stop accepting of LWMQ service:", s.Name)
 }
 
-// FreeCid free cid
-func (s *Lwmq) FreeCid(cid uint32) {
+// CloseConns close connections of service stopped accepting
+func (s *Lwmq) CloseConns() {
 	s.lock.Lock()
-	defer s.lock.Unlock()
 
-	s.cidPool[cid] = 0
+	if s.running {
+		s.lock.Unlock()
+		return
+	}
+
+	closed := s.closer != nil
+	if closed {
+		close(s.quit)
+		s.closer.Close()
+		s.closer = nil
+	}
+
+	conns := make([]*Connection, 0, len(s.conns))
+	for _, c := range s.conns {
+		conns = append(conns, c)
+	}
+
+	s.lock.Unlock()
+
+	// Clients of closed connections are cleaned by client manager
+	for _, c := range conns {
+		c.Close()
+	}
+
+	if closed || (len(conns) > 0) {
+		mlog.Warning("Stop LWMQ service:", s.Name, " connections closed:", len(conns))
+	}
 }
 
-// Stop stop service
-func (s *Lwmq) Stop() {
-	mlog.Error("Stop LWMQ service!")
+// Create service not started
+func newLwmq(name string, network string, ip string, port int) *Lwmq {
+	return &Lwmq{
+		Name:  name,
+		Type:  network,
+		IP:    ip,
+		Port:  port,
+		conns: make(map[uint32]*Connection),
+		lock:  new(sync.Mutex),
+	}
 }
 
 // NewLwmq create lwmq service
 func NewLwmq() iface.Iservicer {
-	return &Lwmq{
-		Name:    "LWMQ",
-		Type:    "tcp4",
-		IP:      "0.0.0.0",
-		Port:    1883,
-		lock:    new(sync.Mutex),
-		cidPool: make([]byte, 1024),
+	return NewLwmqNet("tcp4", "0.0.0.0", 1883)
+}
+
+// NewLwmqNet create lwmq service of network type: tcp, tcp4, tcp6, udp, udp4 or udp6
+func NewLwmqNet(network string, ip string, port int) iface.Iservicer {
+	s := newLwmq("LWMQ-"+strings.ToUpper(network), network, ip, port)
+	s.IdleTimeout = 120 * time.Second
+
+	return s
+}
+
+// NewLwmqTLS create lwmq service over TLS
+func NewLwmqTLS(conf *TLSConfig) iface.Iservicer {
+	port := conf.Port
+	if port == 0 {
+		port = 8883
 	}
+
+	s := newLwmq("LWMQ-TLS", "tls", "0.0.0.0", port)
+	s.TLS = conf
+
+	return s
 }
@@ -0,0 +1,31 @@
+package service
+
+import (
+	"lwmq/metrics"
+)
+
+// Datagrams dropped when queue of virtual connection is full
+var udpDrops = metrics.Default.NewCounter("lwmq_udp_datagrams_dropped_total",
+	"UDP datagrams dropped, queue of connection is full")
+
+// RegisterMetrics register connections of every listener in l
+func (l *Listeners) RegisterMetrics() {
+	metrics.Default.NewGaugeVecFunc("lwmq_connections", "Connections of listener", "listener",
+		func() map[string]float64 {
+			values := make(map[string]float64)
+			for _, s := range l.List() {
+				values[s.Name] = float64(s.GetConnCount())
+			}
+
+			return values
+		})
+}
+
+func init() {
+	metrics.Default.NewGaugeFunc("lwmq_cids_used", "Connection ids in use by all listeners", func() float64 {
+		return float64(Cids.Used())
+	})
+	metrics.Default.NewGaugeFunc("lwmq_cids_capacity", "Max connections of all listeners, max_clients", func() float64 {
+		return float64(Cids.Capacity())
+	})
+}
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// Client certificate verification
+const (
+	VerifyNone     = "none"
+	VerifyOptional = "optional"
+	VerifyRequire  = "require"
+)
+
+// TLSConfig TLS listener config
+type TLSConfig struct {
+	Port             int
+	CertFile         string
+	KeyFile          string
+	MinVersion       string // "1.0", "1.1", "1.2" or "1.3"
+	ClientCAFile     string // CA to verify client certificate
+	VerifyClient     string // none, optional or require
+	CertNameAsUser   bool   // Use common name of client certificate as user name
+	HandshakeTimeout time.Duration
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (c *TLSConfig) handshakeTimeout() time.Duration {
+	if c.HandshakeTimeout > 0 {
+		return c.HandshakeTimeout
+	}
+
+	return 10 * time.Second
+}
+
+// Create TLS config from files
+func (c *TLSConfig) newConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if len(c.MinVersion) > 0 {
+		version, exist := tlsVersions[c.MinVersion]
+		if !exist {
+			return nil, fmt.Errorf("unknown TLS version %q", c.MinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	switch c.VerifyClient {
+	case "", VerifyNone:
+		config.ClientAuth = tls.NoClientCert
+	case VerifyOptional:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case VerifyRequire:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown client verification %q", c.VerifyClient)
+	}
+
+	if config.ClientAuth != tls.NoClientCert {
+		if len(c.ClientCAFile) == 0 {
+			return nil, fmt.Errorf("client CA file is required to verify client certificate")
+		}
+
+		caPem, err := ioutil.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("no certificate in %s", c.ClientCAFile)
+		}
+		config.ClientCAs = pool
+	}
+
+	return config, nil
+}
@@ -0,0 +1,193 @@
+package service
+
+import (
+	"fmt"
+	"lwmq/mlog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Datagrams queued for one virtual connection
+const udpQueueSize = 64
+
+var errUDPClosed = fmt.Errorf("udp connection: %w", net.ErrClosed)
+
+// udpServer map datagrams of remote address to virtual connection
+type udpServer struct {
+	conn  *net.UDPConn
+	conns map[string]*udpConn
+	lock  *sync.Mutex
+}
+
+// udpConn virtual connection of one remote address, works as net.Conn
+type udpConn struct {
+	server   *udpServer
+	remote   *net.UDPAddr
+	packets  chan []byte
+	pending  []byte // Rest of datagram not read
+	lastTime int64
+	once     *sync.Once
+	closed   chan struct{}
+}
+
+// Read read one datagram, rest of datagram is kept for next read
+func (c *udpConn) Read(buff []byte) (int, error) {
+	if len(c.pending) == 0 {
+		select {
+		case data := <-c.packets:
+			c.pending = data
+		case <-c.closed:
+			return 0, errUDPClosed
+		}
+	}
+
+	n := copy(buff, c.pending)
+	c.pending = c.pending[n:]
+
+	return n, nil
+}
+
+// Write send datagram to remote address
+func (c *udpConn) Write(buff []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, errUDPClosed
+	default:
+	}
+
+	return c.server.conn.WriteToUDP(buff, c.remote)
+}
+
+// Close remove virtual connection
+func (c *udpConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+
+		c.server.lock.Lock()
+		delete(c.server.conns, c.remote.String())
+		c.server.lock.Unlock()
+	})
+
+	return nil
+}
+
+func (c *udpConn) LocalAddr() net.Addr                { return c.server.conn.LocalAddr() }
+func (c *udpConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *udpConn) SetDeadline(t time.Time) error      { return nil }
+func (c *udpConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *udpConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// Close virtual connections without datagram in idle timeout
+func (u *udpServer) checkIdle(timeout time.Duration, quit chan struct{}) {
+	for {
+		select {
+		case <-quit:
+			return
+		case <-time.After(time.Second):
+		}
+
+		now := time.Now().Unix()
+		var idle []*udpConn
+
+		u.lock.Lock()
+		for _, c := range u.conns {
+			if now-atomic.LoadInt64(&c.lastTime) > int64(timeout/time.Second) {
+				idle = append(idle, c)
+			}
+		}
+		u.lock.Unlock()
+
+		for _, c := range idle {
+			mlog.Debug("UDP connection idle:", c.remote.String())
+			c.Close()
+		}
+	}
+}
+
+// Get virtual connection of remote address, create one if not exist
+func (u *udpServer) getConn(remote *net.UDPAddr) (*udpConn, bool) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	key := remote.String()
+	c, exist := u.conns[key]
+	if exist {
+		return c, false
+	}
+
+	c = &udpConn{
+		server:   u,
+		remote:   remote,
+		packets:  make(chan []byte, udpQueueSize),
+		lastTime: time.Now().Unix(),
+		once:     new(sync.Once),
+		closed:   make(chan struct{}),
+	}
+	u.conns[key] = c
+
+	return c, true
+}
+
+// Listen for datagrams, MQTT-SN style constrained devices
+func (s *Lwmq) listenUDP() (func(quit chan struct{}), error) {
+	addr, err := net.ResolveUDPAddr(s.Type, s.address())
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP(s.Type, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mlog.Debug("Listen UDP on:", addr.String())
+
+	s.closer = conn
+	return func(quit chan struct{}) { s.serveUDP(conn, quit) }, nil
+}
+
+// Loop read datagrams until service stops
+func (s *Lwmq) serveUDP(conn *net.UDPConn, quit chan struct{}) {
+	u := &udpServer{
+		conn:  conn,
+		conns: make(map[string]*udpConn),
+		lock:  new(sync.Mutex),
+	}
+	go u.checkIdle(s.IdleTimeout, quit)
+
+	buff := make([]byte, 65536)
+	for {
+		n, remote, err := conn.ReadFromUDP(buff)
+		if err != nil {
+			select {
+			case <-quit:
+				return
+			default:
+			}
+
+			mlog.Error("Read UDP error:", err)
+			continue
+		}
+
+		c, isNew := u.getConn(remote)
+		if isNew {
+			if s.accept(c, remote.String(), "") == nil {
+				c.Close()
+				continue
+			}
+		}
+		atomic.StoreInt64(&c.lastTime, time.Now().Unix())
+
+		data := make([]byte, n)
+		copy(data, buff[:n])
+
+		select {
+		case c.packets <- data:
+		default:
+			mlog.Warning("UDP queue full, drop datagram:", remote.String())
+			udpDrops.Inc()
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"fmt"
+	"lwmq/iface"
+	"lwmq/mlog"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/websocket"
+)
+
+// MQTT over WebSocket subprotocol, MQTT-6.0
+const wsProtocol = "mqtt"
+
+// Accept only clients asking for mqtt subprotocol
+func wsHandshake(config *websocket.Config, req *http.Request) error {
+	for _, protocol := range config.Protocol {
+		if protocol == wsProtocol {
+			config.Protocol = []string{wsProtocol}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("websocket subprotocol %q is required", wsProtocol)
+}
+
+// Listen for WebSocket connections
+func (s *Lwmq) listenWebSocket() (func(quit chan struct{}), error) {
+	mux := http.NewServeMux()
+	mux.Handle(s.Path, websocket.Server{
+		Handshake: wsHandshake,
+		Handler:   s.acceptWebSocket,
+	})
+
+	listener, err := net.Listen("tcp", s.address())
+	if err != nil {
+		return nil, err
+	}
+
+	mlog.Debug("Listen WebSocket on:", listener.Addr().String(), s.Path)
+
+	server := &http.Server{Handler: mux}
+	s.closer = server
+
+	return func(quit chan struct{}) {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			mlog.Error("Serve WebSocket error:", err)
+		}
+	}, nil
+}
+
+// Handle one WebSocket connection, binary frames carry MQTT data
+func (s *Lwmq) acceptWebSocket(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+
+	// Remote address of websocket.Conn is the origin, use address of request
+	connection := s.accept(ws, ws.Request().RemoteAddr, "")
+	if connection == nil {
+		return
+	}
+
+	// WebSocket is closed when handler returns
+	<-connection.closed
+}
+
+// NewLwmqWS create lwmq service over WebSocket
+func NewLwmqWS(port int, path string) iface.Iservicer {
+	if port == 0 {
+		port = 8083
+	}
+
+	if len(path) == 0 {
+		path = "/mqtt"
+	}
+
+	s := newLwmq("LWMQ-WS", "ws", "0.0.0.0", port)
+	s.Path = path
+
+	return s
+}
@@ -0,0 +1,381 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"lwmq/mlog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record kind
+const (
+	kindSession = iota
+	kindRetain
+	kindInflight
+	kindMax
+)
+
+// Record operation
+const (
+	opPut = iota
+	opDel
+)
+
+// Compact when superseded records exceed live records and this count
+const compactMin = 1024
+
+type record struct {
+	Op   byte            `json:"op"`
+	Kind byte            `json:"kind"`
+	Key  string          `json:"key"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// FileStore append-only log of records, live records are also kept in memory
+// and the log is rewritten with live records only when it grows too large
+type FileStore struct {
+	Path         string
+	file         *os.File
+	live         [kindMax]map[string]json.RawMessage
+	records      int           // Records in log file
+	syncInterval time.Duration // 0 syncs log after every write
+	dirty        bool          // Written since last sync
+	quit         chan struct{} // Closed when store is closed
+	lock         *sync.Mutex
+}
+
+// NewFileStore open log file, replay and compact it. Log is synced after
+// every write if syncInterval is 0, else every syncInterval, records written
+// in last interval may be lost on power failure
+func NewFileStore(path string, syncInterval time.Duration) (*FileStore, error) {
+	s := &FileStore{
+		Path:         path,
+		syncInterval: syncInterval,
+		quit:         make(chan struct{}),
+		lock:         new(sync.Mutex),
+	}
+
+	for i := range s.live {
+		s.live[i] = make(map[string]json.RawMessage)
+	}
+
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+
+	if syncInterval > 0 {
+		go s.syncWork()
+	}
+
+	return s, nil
+}
+
+// Sync records written in last interval until store is closed
+func (s *FileStore) syncWork() {
+	ticker := time.NewTicker(s.syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-ticker.C:
+		}
+
+		s.lock.Lock()
+		if s.dirty && (s.file != nil) {
+			if err := s.file.Sync(); err != nil {
+				mlog.Error("Sync store error:", s.Path, " ", err)
+			}
+			s.dirty = false
+		}
+		s.lock.Unlock()
+	}
+}
+
+// Read log file into memory
+func (s *FileStore) replay() error {
+	file, err := os.Open(s.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	lineNo := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			lineNo++
+
+			var rec record
+			if jerr := json.Unmarshal(line, &rec); jerr != nil || rec.Kind >= kindMax {
+				// Last record may be torn by crash
+				mlog.Warning("Skip bad record:", s.Path, " line:", lineNo)
+			} else {
+				s.apply(&rec)
+			}
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (s *FileStore) apply(rec *record) {
+	if rec.Op == opDel {
+		delete(s.live[rec.Kind], rec.Key)
+	} else {
+		s.live[rec.Kind][rec.Key] = rec.Data
+	}
+}
+
+func (s *FileStore) liveCount() int {
+	count := 0
+	for i := range s.live {
+		count += len(s.live[i])
+	}
+
+	return count
+}
+
+// Rewrite log with live records, lock must be held. Old log is kept and
+// written on if rewrite fails
+func (s *FileStore) compact() error {
+	tmpPath := s.Path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+encode:
+	for kind := range s.live {
+		for key, data := range s.live[kind] {
+			rec := &record{Op: opPut, Kind: byte(kind), Key: key, Data: data}
+			if err = encoder.Encode(rec); err != nil {
+				break encode
+			}
+		}
+	}
+
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		// Handle of new log follows it when renamed
+		err = os.Rename(tmpPath, s.Path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	syncDir(s.Path)
+
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file = tmp
+	s.dirty = false
+
+	s.records = s.liveCount()
+	mlog.Debug("Store compacted:", s.Path, " records:", s.records)
+
+	return nil
+}
+
+// Sync directory of file to keep rename on crash
+func syncDir(path string) {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return
+	}
+
+	dir.Sync()
+	dir.Close()
+}
+
+// Append one record to log
+func (s *FileStore) write(op byte, kind byte, key string, v interface{}) error {
+	rec := &record{Op: op, Kind: kind, Key: key}
+	if v != nil {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		rec.Data = data
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.file == nil {
+		return fmt.Errorf("store closed")
+	}
+
+	if op == opDel {
+		if _, exist := s.live[kind][key]; !exist {
+			return nil
+		}
+	}
+
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	s.apply(rec)
+	s.records++
+
+	if s.syncInterval == 0 {
+		if err := s.file.Sync(); err != nil {
+			return err
+		}
+	} else {
+		s.dirty = true
+	}
+
+	if garbage := s.records - s.liveCount(); garbage > compactMin && garbage > s.liveCount() {
+		return s.compact()
+	}
+
+	return nil
+}
+
+func inflightKey(clientID string, pid uint32, state byte) string {
+	// Received pids of client are separated from sent pids
+	if state == Received {
+		return fmt.Sprintf("%s\x00r%d", clientID, pid)
+	}
+
+	return fmt.Sprintf("%s\x00s%d", clientID, pid)
+}
+
+// SaveSession save session
+func (s *FileStore) SaveSession(session *Session) error {
+	return s.write(opPut, kindSession, session.ClientID, session)
+}
+
+// DeleteSession delete session and inflight of session
+func (s *FileStore) DeleteSession(clientID string) error {
+	s.lock.Lock()
+	var keys []string
+	prefix := clientID + "\x00"
+	for key := range s.live[kindInflight] {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	s.lock.Unlock()
+
+	for _, key := range keys {
+		if err := s.write(opDel, kindInflight, key, nil); err != nil {
+			return err
+		}
+	}
+
+	return s.write(opDel, kindSession, clientID, nil)
+}
+
+// SaveRetain save retained message
+func (s *FileStore) SaveRetain(msg *Message) error {
+	return s.write(opPut, kindRetain, msg.Topic, msg)
+}
+
+// DeleteRetain delete retained message
+func (s *FileStore) DeleteRetain(topic string) error {
+	return s.write(opDel, kindRetain, topic, nil)
+}
+
+// SaveInflight save inflight message
+func (s *FileStore) SaveInflight(inflight *Inflight) error {
+	key := inflightKey(inflight.ClientID, inflight.Pid, inflight.State)
+	return s.write(opPut, kindInflight, key, inflight)
+}
+
+// DeleteInflight delete inflight message
+func (s *FileStore) DeleteInflight(clientID string, pid uint32, state byte) error {
+	return s.write(opDel, kindInflight, inflightKey(clientID, pid, state), nil)
+}
+
+// Load decode all live records
+func (s *FileStore) Load() (*State, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	state := &State{}
+
+	for _, data := range s.live[kindSession] {
+		session := &Session{}
+		if err := json.Unmarshal(data, session); err != nil {
+			return nil, err
+		}
+		state.Sessions = append(state.Sessions, session)
+	}
+
+	for _, data := range s.live[kindRetain] {
+		msg := &Message{}
+		if err := json.Unmarshal(data, msg); err != nil {
+			return nil, err
+		}
+		state.Retains = append(state.Retains, msg)
+	}
+
+	for _, data := range s.live[kindInflight] {
+		inflight := &Inflight{}
+		if err := json.Unmarshal(data, inflight); err != nil {
+			return nil, err
+		}
+		state.Inflight = append(state.Inflight, inflight)
+	}
+
+	// Keep publish order of inflight messages
+	sort.Slice(state.Inflight, func(i, j int) bool {
+		return state.Inflight[i].Seq < state.Inflight[j].Seq
+	})
+
+	return state, nil
+}
+
+// Close sync and close log file
+func (s *FileStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	close(s.quit)
+
+	err := s.file.Sync()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	s.file = nil
+
+	return err
+}
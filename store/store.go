@@ -0,0 +1,63 @@
+package store
+
+// Inflight state
+const (
+	WaitAck  = iota // Qos 1 sent, wait PUBACK
+	WaitRec         // Qos 2 sent, wait PUBREC
+	WaitComp        // Qos 2 PUBREL sent, wait PUBCOMP
+	Received        // Qos 2 received from client, wait PUBREL
+)
+
+// Subscription subscribe topic of session
+type Subscription struct {
+	Topic string `json:"topic"`
+	Qos   byte   `json:"qos"`
+}
+
+// Session persistent session, clean session = 0
+type Session struct {
+	ClientID      string          `json:"clientid"`
+	Username      string          `json:"username,omitempty"`
+	ConnectFlag   byte            `json:"flag"`
+	CreateTime    string          `json:"create"`
+	Subscriptions []*Subscription `json:"subs,omitempty"`
+}
+
+// Message retained message
+type Message struct {
+	Topic   string `json:"topic"`
+	Qos     byte   `json:"qos"`
+	Payload []byte `json:"payload"`
+}
+
+// Inflight Qos 1 and 2 message of session not acknowledged
+type Inflight struct {
+	Seq      uint64 `json:"seq"`            // Publish order
+	Time     int64  `json:"time,omitempty"` // Unix time of publish
+	ClientID string `json:"clientid"`
+	Pid      uint32 `json:"pid"`
+	State    byte   `json:"state"`
+	Topic    string `json:"topic,omitempty"`
+	Qos      byte   `json:"qos"`
+	Retain   bool   `json:"retain,omitempty"`
+	Payload  []byte `json:"payload,omitempty"`
+}
+
+// State all data in store
+type State struct {
+	Sessions []*Session
+	Retains  []*Message
+	Inflight []*Inflight
+}
+
+// Store persistence of broker state
+type Store interface {
+	SaveSession(*Session) error
+	DeleteSession(clientID string) error // Also delete inflight of session
+	SaveRetain(*Message) error
+	DeleteRetain(topic string) error
+	SaveInflight(*Inflight) error
+	DeleteInflight(clientID string, pid uint32, state byte) error
+	Load() (*State, error)
+	Close() error
+}
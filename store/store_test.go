@@ -0,0 +1,278 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openStore(t *testing.T, path string) *FileStore {
+	s, err := NewFileStore(path, 0)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+
+	return s
+}
+
+func loadStore(t *testing.T, path string) *State {
+	s := openStore(t, path)
+	defer s.Close()
+
+	state, err := s.Load()
+	if err != nil {
+		t.Fatalf("load store: %v", err)
+	}
+
+	return state
+}
+
+func countLines(t *testing.T, path string) int {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.Count(string(data), "\n")
+}
+
+func TestReplayAfterReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lwmq.db")
+
+	s := openStore(t, path)
+	for _, err := range []error{
+		s.SaveSession(&Session{ClientID: "a", ConnectFlag: 0, Subscriptions: []*Subscription{{Topic: "x/#", Qos: 1}}}),
+		s.SaveSession(&Session{ClientID: "b"}),
+		s.SaveRetain(&Message{Topic: "x/y", Qos: 1, Payload: []byte("on")}),
+		s.SaveInflight(&Inflight{Seq: 2, ClientID: "a", Pid: 7, State: WaitRec, Topic: "x/y", Qos: 2}),
+		s.SaveInflight(&Inflight{Seq: 1, ClientID: "a", Pid: 6, State: WaitAck, Topic: "x/z", Qos: 1}),
+		s.SaveInflight(&Inflight{ClientID: "a", Pid: 7, State: Received}),
+		// PUBREC received, replaces WaitRec of same pid
+		s.SaveInflight(&Inflight{Seq: 2, ClientID: "a", Pid: 7, State: WaitComp, Topic: "x/y", Qos: 2}),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	state := loadStore(t, path)
+	if len(state.Sessions) != 2 {
+		t.Fatalf("sessions %d, want 2", len(state.Sessions))
+	}
+	if (len(state.Retains) != 1) || (string(state.Retains[0].Payload) != "on") {
+		t.Fatalf("retains %+v", state.Retains)
+	}
+	if len(state.Inflight) != 3 {
+		t.Fatalf("inflight %d, want 3", len(state.Inflight))
+	}
+
+	// Publish order, received pid has no seq
+	if (state.Inflight[0].State != Received) || (state.Inflight[1].Pid != 6) ||
+		(state.Inflight[2].Pid != 7) || (state.Inflight[2].State != WaitComp) {
+		for _, inflight := range state.Inflight {
+			t.Logf("%+v", inflight)
+		}
+		t.Fatal("inflight not in publish order")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lwmq.db")
+
+	s := openStore(t, path)
+	s.SaveSession(&Session{ClientID: "a"})
+	s.SaveSession(&Session{ClientID: "ab"})
+	s.SaveInflight(&Inflight{ClientID: "a", Pid: 1, State: WaitAck})
+	s.SaveInflight(&Inflight{ClientID: "a", Pid: 2, State: Received})
+	s.SaveInflight(&Inflight{ClientID: "ab", Pid: 1, State: WaitAck})
+	s.SaveRetain(&Message{Topic: "t", Payload: []byte("x")})
+
+	lines := countLines(t, path)
+
+	// Session "a" with its inflight, prefix "a" of "ab" is not matched
+	if err := s.DeleteSession("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteRetain("t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteInflight("ab", 1, WaitComp); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleting missing record writes nothing
+	deleted := countLines(t, path)
+	if err := s.DeleteSession("none"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteRetain("none"); err != nil {
+		t.Fatal(err)
+	}
+	if got := countLines(t, path); (got != deleted) || (deleted != lines+5) {
+		t.Fatalf("lines %d after delete, %d after missing delete, want %d", deleted, got, lines+5)
+	}
+	s.Close()
+
+	state := loadStore(t, path)
+	if (len(state.Sessions) != 1) || (state.Sessions[0].ClientID != "ab") {
+		t.Fatalf("sessions %+v", state.Sessions)
+	}
+	if (len(state.Retains) != 0) || (len(state.Inflight) != 0) {
+		t.Fatalf("retains %d inflight %d, want none", len(state.Retains), len(state.Inflight))
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lwmq.db")
+
+	s := openStore(t, path)
+	defer s.Close()
+
+	for i := 0; i < 3*compactMin; i++ {
+		if err := s.SaveRetain(&Message{Topic: fmt.Sprintf("t/%d", i%4), Payload: []byte(fmt.Sprint(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if lines := countLines(t, path); lines > compactMin+4 {
+		t.Fatalf("log has %d lines, not compacted", lines)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temp file left: %v", err)
+	}
+
+	s.Close()
+	state := loadStore(t, path)
+	if len(state.Retains) != 4 {
+		t.Fatalf("retains %d, want 4", len(state.Retains))
+	}
+	for _, msg := range state.Retains {
+		var i int
+		fmt.Sscan(strings.TrimPrefix(msg.Topic, "t/"), &i)
+		if want := fmt.Sprint(3*compactMin - 4 + i); string(msg.Payload) != want {
+			t.Fatalf("retain %s: payload %s, want %s", msg.Topic, msg.Payload, want)
+		}
+	}
+}
+
+func TestCompactionFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lwmq.db")
+
+	s := openStore(t, path)
+	defer s.Close()
+	s.SaveSession(&Session{ClientID: "a"})
+	s.SaveRetain(&Message{Topic: "t", Payload: []byte("x")})
+
+	// Temp file can not be created
+	if err := os.Mkdir(path+".tmp", 0700); err != nil {
+		t.Fatal(err)
+	}
+	s.lock.Lock()
+	err := s.compact()
+	s.lock.Unlock()
+	if err == nil {
+		t.Fatal("compaction succeeded without temp file")
+	}
+	os.Remove(path + ".tmp")
+
+	// Record which can not be encoded, error is not cleared by later records
+	for i := 0; i < 10; i++ {
+		s.lock.Lock()
+		s.live[kindSession]["bad"] = json.RawMessage("{")
+		err := s.compact()
+		delete(s.live[kindSession], "bad")
+		s.lock.Unlock()
+		if err == nil {
+			t.Fatal("compaction succeeded with bad record")
+		}
+	}
+
+	// Old log is still written
+	if err := s.SaveSession(&Session{ClientID: "b"}); err != nil {
+		t.Fatalf("write after failed compaction: %v", err)
+	}
+	s.Close()
+
+	state := loadStore(t, path)
+	if (len(state.Sessions) != 2) || (len(state.Retains) != 1) {
+		t.Fatalf("sessions %d retains %d, want 2 and 1", len(state.Sessions), len(state.Retains))
+	}
+}
+
+func TestTornLastRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lwmq.db")
+
+	s := openStore(t, path)
+	s.SaveSession(&Session{ClientID: "a"})
+	s.SaveSession(&Session{ClientID: "b"})
+	s.Close()
+
+	// Crash in the middle of appending a record
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"op":0,"kind":0,"key":"c","data":{"clientid":"c"`)
+	file.Close()
+
+	s = openStore(t, path)
+	if err := s.SaveSession(&Session{ClientID: "d"}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	state := loadStore(t, path)
+	var ids []string
+	for _, session := range state.Sessions {
+		ids = append(ids, session.ClientID)
+	}
+	if len(ids) != 3 {
+		t.Fatalf("sessions %v, want a, b and d", ids)
+	}
+}
+
+func TestSyncInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lwmq.db")
+
+	s, err := NewFileStore(path, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SaveSession(&Session{ClientID: "a"})
+
+	s.lock.Lock()
+	dirty := s.dirty
+	s.lock.Unlock()
+	if !dirty {
+		t.Fatal("write not marked for sync")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for dirty && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+		s.lock.Lock()
+		dirty = s.dirty
+		s.lock.Unlock()
+	}
+	if dirty {
+		t.Fatal("log not synced in interval")
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("second close: %v", err)
+	}
+	if err := s.SaveSession(&Session{ClientID: "b"}); err == nil {
+		t.Fatal("write after close succeeded")
+	}
+}